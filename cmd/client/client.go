@@ -1,35 +1,100 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/anjmao/friends/pkg/client"
+	"github.com/anjmao/friends/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	protocol = flag.String("protocol", "tcp", "Friends network protocol")
-	addr     = flag.String("addr", ":8080", "Server address")
-	user     = flag.String("user", "", "User payload")
+	protocol    = flag.String("protocol", "tcp", "Friends network protocol: tcp, udp or ws")
+	addr        = flag.String("addr", ":8080", "Server address")
+	user        = flag.String("user", "", "User payload")
+	framing     = flag.String("framing", "frame", "Message framing: frame or line (legacy newline terminated)")
+	codec       = flag.String("codec", "json", "Preferred payload codec used with frames: json or binary")
+	compression = flag.String("compression", "", "Payload compression requested from the server: deflate")
+	presence    = flag.String("presence", "", "Presence set after login: online, away, busy or invisible")
+	status      = flag.String("status", "", "Status message set together with -presence")
+	useTLS      = flag.Bool("tls", false, "Connect over TLS, only supported with tcp protocol")
+	tlsCA       = flag.String("tls-ca", "", "PEM CA file used to verify server certificate, system roots are used if not set")
+	tlsCert     = flag.String("tls-cert", "", "PEM client certificate file for servers which verify clients")
+	tlsKey      = flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	tlsServer   = flag.String("tls-server-name", "", "Expected server name in its certificate, host from -addr (localhost if empty) is used if not set")
+	encrypt     = flag.Bool("encrypt", false, "Encrypt datagrams, only supported with udp protocol and frame framing")
 )
 
 func main() {
 	flag.Parse()
 
+	payloadCodec, err := types.CodecByName(*codec)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	opts := []client.Option{client.WithCodec(payloadCodec), client.WithCompression(*compression)}
+
+	switch *framing {
+	case "frame":
+	case "line":
+		if payloadCodec != types.JSON || *compression != "" {
+			logrus.Fatal("codec and compression require frame framing")
+		}
+		opts = append(opts, client.WithLineProtocol())
+	default:
+		logrus.Fatalf("unknown framing %s", *framing)
+	}
+
+	if *encrypt {
+		if *protocol != "udp" || *framing != "frame" {
+			logrus.Fatal("encryption is only supported with udp protocol and frame framing")
+		}
+		opts = append(opts, client.WithEncryption())
+	}
+
+	if *useTLS {
+		if *protocol != "tcp" {
+			logrus.Fatal("tls is only supported with tcp protocol")
+		}
+		tlsConfig, err := client.LoadTLSConfig(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tlsConfig.ServerName = *tlsServer
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(*addr)
+			if err != nil {
+				logrus.Fatalf("invalid -addr %q, could not take -tls-server-name from it: %v", *addr, err)
+			}
+			if host == "" {
+				host = "localhost"
+			}
+			tlsConfig.ServerName = host
+		}
+		opts = append(opts, client.WithTLS(tlsConfig))
+	}
+
 	var c client.Friends
 	switch *protocol {
 	case "tcp":
-		c = client.NewTCPClient()
+		c = client.NewTCPClient(opts...)
 	case "udp":
-		c = client.NewUDPClient()
+		c = client.NewUDPClient(opts...)
+	case "ws":
+		c = client.NewWSClient(opts...)
 	default:
 		logrus.Fatalf("unknown protocol %s", *protocol)
 	}
 
-	gracefulStop := make(chan os.Signal)
+	gracefulStop := make(chan os.Signal, 1)
 	signal.Notify(gracefulStop, syscall.SIGTERM)
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	go func() {
@@ -44,6 +109,66 @@ func main() {
 		logrus.Fatalf("could not connect to %s on protocol %s: %v", *addr, *protocol, err)
 	}
 
+	go func() {
+		for err := range c.Errors() {
+			logrus.Errorf("server error: %v", err)
+		}
+	}()
+	if *presence != "" {
+		if err := setPresence(c, *presence, *status); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	go readCommands(c)
 	go c.PingLoop()
 	c.ListenIncoming()
 }
+
+// readCommands changes presence from stdin lines in "<presence> [message]"
+// form, e.g. "away back in 10 minutes", and queries friends last seen
+// time with "lastseen [user_id...]" lines.
+func readCommands(c client.Friends) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if fields := strings.Fields(line); fields[0] == "lastseen" {
+			if err := queryLastSeen(c, fields[1:]); err != nil {
+				logrus.Error(err)
+			}
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		message := ""
+		if len(parts) == 2 {
+			message = strings.TrimSpace(parts[1])
+		}
+		if err := setPresence(c, parts[0], message); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+func queryLastSeen(c client.Friends, ids []string) error {
+	friends := make([]int, 0, len(ids))
+	for _, id := range ids {
+		friendID, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid user id %q", id)
+		}
+		friends = append(friends, friendID)
+	}
+	return c.QueryLastSeen(friends...)
+}
+
+func setPresence(c client.Friends, name, message string) error {
+	p, err := types.ParsePresence(name)
+	if err != nil {
+		return err
+	}
+	return c.SetPresence(p, message)
+}
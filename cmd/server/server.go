@@ -1,40 +1,185 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/anjmao/friends/pkg/server"
+	"github.com/anjmao/friends/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	protocol = flag.String("protocol", "tcp", "Friends server protocol")
-	addr     = flag.String("addr", ":8080", "Serve address")
+	protocol    = flag.String("protocol", "tcp", "Friends server protocol, ignored if -listen is set")
+	addr        = flag.String("addr", ":8080", "Serve address, ignored if -listen is set")
+	codec       = flag.String("codec", "json", "Preferred payload codec for framed clients: json or binary")
+	friendsFile = flag.String("friends-file", "", "JSON file with user friends, e.g. {\"1\": [2, 3]}. Friends sent by clients are trusted if not set")
+	mutual      = flag.Bool("mutual", false, "Deliver presence only between users who list each other as friends")
+	loginPolicy = flag.String("login-policy", "allow-multiple", "Duplicate login policy: allow-multiple, reject-new or kick-old")
+	authSecret  = flag.String("auth-secret", "", "Secret used to verify login tokens, logins are not authenticated if not set")
+	tlsCert     = flag.String("tls-cert", "", "PEM certificate file, TCP listeners serve TLS if set together with -tls-key")
+	tlsKey      = flag.String("tls-key", "", "PEM private key file of -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "PEM CA file, TLS clients must present certificate signed by it if set")
+	encryption  = flag.Bool("require-encryption", false, "Reject UDP clients which don't encrypt datagrams")
+	idleTimeout = flag.Duration("udp-idle-timeout", time.Minute, "Forget UDP clients which send nothing for this long")
+	listen      listenFlags
 )
 
+const shutdownTimeout = 5 * time.Second
+
+func init() {
+	flag.Var(&listen, "listen", "Listener in protocol://addr form, e.g. tcp://:8080, udp://:8081 or ws://:8082. Could be repeated")
+}
+
+// listenFlags collects repeated -listen flags.
+type listenFlags []string
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listenFlags) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// listener is a server bound to a single address.
+type listener struct {
+	protocol string
+	addr     string
+	srv      server.Friends
+}
+
+// parseListen splits protocol://addr into parts.
+func parseListen(v string) (protocol, addr string, err error) {
+	parts := strings.SplitN(v, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid listen address %q, expected protocol://addr", v)
+	}
+	return parts[0], parts[1], nil
+}
+
 func main() {
 	flag.Parse()
 
-	hub := server.NewHub()
+	payloadCodec, err := types.CodecByName(*codec)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if len(listen) == 0 {
+		listen = listenFlags{*protocol + "://" + *addr}
+	}
+
+	policy, err := server.ParseLoginPolicy(*loginPolicy)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	hubOpts := []server.HubOption{server.WithLoginPolicy(policy)}
+	if *mutual {
+		hubOpts = append(hubOpts, server.WithMutualFriendship())
+	}
+	if *authSecret != "" {
+		hubOpts = append(hubOpts, server.WithAuthenticator(server.NewHMACAuthenticator([]byte(*authSecret))))
+	}
+	if *friendsFile != "" {
+		graph, err := server.NewFileGraph(*friendsFile)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		hubOpts = append(hubOpts, server.WithFriendGraph(graph))
+	}
+
+	tcpOpts := []server.Option{server.WithCodec(payloadCodec)}
+	if *tlsCert != "" || *tlsKey != "" {
+		tlsConfig, err := server.LoadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		tcpOpts = append(tcpOpts, server.WithTLS(tlsConfig))
+	} else if *tlsClientCA != "" {
+		logrus.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	udpOpts := []server.Option{server.WithCodec(payloadCodec), server.WithIdleTimeout(*idleTimeout)}
+	if *encryption {
+		udpOpts = append(udpOpts, server.WithRequiredEncryption())
+	}
+
+	hub := server.NewHub(hubOpts...)
+	var listeners []*listener
+	for _, v := range listen {
+		protocol, addr, err := parseListen(v)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var srv server.Friends
+		switch protocol {
+		case "tcp":
+			srv = server.NewTCPServer(tcpOpts...)
+		case "udp":
+			srv = server.NewUDPServer(udpOpts...)
+		case "ws":
+			srv = server.NewWSServer(server.WithCodec(payloadCodec))
+		default:
+			logrus.Fatalf("unknown protocol %s", protocol)
+		}
+
+		// All servers share the same hub so users see each other
+		// regardless of the protocol they use.
+		srv.Handle(hub.IncomingMessageHandler)
+		srv.HandleDisconnect(hub.DisconnectHandler)
+		listeners = append(listeners, &listener{protocol: protocol, addr: addr, srv: srv})
+	}
+
 	checkTicker := time.NewTicker(server.CheckUsersStateInterval)
 	defer checkTicker.Stop()
 	done := make(chan struct{})
 	go hub.Run(checkTicker.C, done)
 
-	var srv server.Friends
-	switch *protocol {
-	case "tcp":
-		srv = server.NewTCPServer()
-	case "udp":
-		srv = server.NewUDPServer()
-	default:
-		logrus.Fatalf("unknown protocol %s", *protocol)
-	}
+	gracefulStop := make(chan os.Signal, 1)
+	signal.Notify(gracefulStop, syscall.SIGTERM)
+	signal.Notify(gracefulStop, syscall.SIGINT)
+	stopped := make(chan struct{})
+	go func() {
+		<-gracefulStop
+		logrus.Info("shutting down server")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
 
-	srv.Handle(hub.IncomingMessageHandler)
-	if err := srv.ListenAndServe(*addr); err != nil {
-		done<- struct{}{}
-		logrus.Fatal(err)
+		// Notify users while connections are still open, then close them.
+		if err := hub.Shutdown(ctx); err != nil {
+			logrus.Errorf("could not shutdown hub: %v", err)
+		}
+		for _, l := range listeners {
+			if err := l.srv.Shutdown(ctx); err != nil {
+				logrus.Errorf("could not shutdown %s server: %v", l.protocol, err)
+			}
+		}
+		close(done)
+		close(stopped)
+	}()
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			logrus.Infof("listening %s on %s", l.protocol, l.addr)
+			if err := l.srv.ListenAndServe(l.addr); err != server.ErrServerClosed {
+				logrus.Fatalf("%s server on %s failed: %v", l.protocol, l.addr, err)
+			}
+		}(l)
 	}
+	wg.Wait()
+	<-stopped
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/anjmao/friends/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	secret = flag.String("secret", "", "Secret shared with the server, see server -auth-secret")
+	userID = flag.Int("user", 0, "User ID the token is issued for")
+	ttl    = flag.Duration("ttl", 24*time.Hour, "How long token is valid")
+)
+
+// token prints login token for testing servers started with -auth-secret.
+func main() {
+	flag.Parse()
+
+	if *secret == "" {
+		logrus.Fatal("secret is required")
+	}
+	auth := server.NewHMACAuthenticator([]byte(*secret))
+	fmt.Println(auth.Token(*userID, time.Now().Add(*ttl)))
+}
@@ -1,3 +1,11 @@
 module github.com/anjmao/friends
 
+go 1.24
+
 require github.com/sirupsen/logrus v1.3.0
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793 // indirect
+	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33 // indirect
+)
@@ -1,9 +1,35 @@
 package client
 
-// Friends interface describe common client abstraction over TCP/UDP.
+import (
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+const (
+	pingInterval = 100 * time.Millisecond
+	// handshakeTimeout limits how long client waits for hello reply.
+	handshakeTimeout = 3 * time.Second
+	// loginTimeout limits how long client waits for the
+	// server to accept or reject login.
+	loginTimeout = 3 * time.Second
+)
+
+// Friends interface describe common client abstraction over TCP/UDP/WebSocket.
 type Friends interface {
 	Connect(addr, user string) error
 	PingLoop()
 	ListenIncoming()
 	Close() error
+	// SetPresence changes user's presence and status message
+	// which are sent to his friends.
+	SetPresence(presence types.Presence, message string) error
+	// QueryLastSeen asks for status of the given friends, or all friends
+	// if none given. Reply updates Presence with last seen times.
+	QueryLastSeen(friends ...int) error
+	// Presence returns last known status of user's friends.
+	Presence() map[int]types.StatusChangeReply
+	// Errors returns errors replied by the server, each of them
+	// is *types.ErrorReply.
+	Errors() <-chan error
 }
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"crypto/tls"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// Option configures TCP/UDP client.
+type Option func(*options)
+
+type options struct {
+	lineProtocol bool
+	codec        types.Codec
+	compression  string
+	tls          *tls.Config
+	encryption   bool
+}
+
+func newOptions(opts []Option) options {
+	o := options{codec: types.JSON}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithLineProtocol makes client talk using legacy newline terminated
+// messages instead of length prefixed frames.
+func WithLineProtocol() Option {
+	return func(o *options) {
+		o.lineProtocol = true
+	}
+}
+
+// WithCodec sets preferred payload codec which is offered to the server
+// during handshake. Codec is used only with frames, legacy newline
+// messages are always encoded as JSON.
+func WithCodec(c types.Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithCompression asks the server to compress payloads
+// with the given algorithm.
+func WithCompression(compression string) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithTLS makes TCP client connect using TLS.
+// UDP and WebSocket clients ignore it.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithEncryption makes UDP client agree on keys with the server during
+// handshake and seal all datagrams. It requires frames, TCP and
+// WebSocket clients ignore it.
+func WithEncryption() Option {
+	return func(o *options) {
+		o.encryption = true
+	}
+}
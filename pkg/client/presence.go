@@ -0,0 +1,80 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// presence holds client side view of friends status. It is seeded
+// from the login snapshot and kept up to date by status changes.
+//
+// Retransmitted messages could arrive out of order, so each status
+// is stored with sequence number of its message and older statuses
+// are ignored. Zero sequence number means message was not sequenced.
+type presence struct {
+	mu      sync.RWMutex
+	friends map[int]types.StatusChangeReply
+	seqs    map[int]uint64
+}
+
+// Presence returns a copy of currently known friends status.
+func (p *presence) Presence() map[int]types.StatusChangeReply {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	res := make(map[int]types.StatusChangeReply, len(p.friends))
+	for id, s := range p.friends {
+		res[id] = s
+	}
+	return res
+}
+
+func (p *presence) setSnapshot(snapshot *types.PresenceSnapshotReply, seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	friends := make(map[int]types.StatusChangeReply, len(snapshot.Friends))
+	// Keep statuses which are newer than snapshot.
+	for id, s := range p.friends {
+		if seq != 0 && p.seqs[id] > seq {
+			friends[id] = s
+		}
+	}
+	p.friends = friends
+	for i := range snapshot.Friends {
+		p.set(&snapshot.Friends[i], seq)
+	}
+}
+
+func (p *presence) setStatus(status *types.StatusChangeReply, seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.set(status, seq)
+}
+
+// set stores status unless newer one is already known.
+// It must be called with mu held.
+func (p *presence) set(status *types.StatusChangeReply, seq uint64) {
+	if p.friends == nil {
+		p.friends = make(map[int]types.StatusChangeReply)
+	}
+	if p.seqs == nil {
+		p.seqs = make(map[int]uint64)
+	}
+	if seq != 0 && seq < p.seqs[status.UserID] {
+		return
+	}
+	p.friends[status.UserID] = *status
+	p.seqs[status.UserID] = seq
+}
+
+// setAllOffline marks all friends offline as server which
+// could tell otherwise is gone.
+func (p *presence) setAllOffline() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, s := range p.friends {
+		s.Online = false
+		p.friends[id] = s
+	}
+}
@@ -0,0 +1,400 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/anjmao/friends/pkg/secure"
+	"github.com/anjmao/friends/pkg/types"
+)
+
+const errorsBufferSize = 16
+
+// transport reads and sends messages over connection of a single
+// protocol, everything else is shared by clients in state.
+type transport interface {
+	readMessage() (*types.Msg, error)
+	sendMessage(cmd types.CommandType, v interface{}) error
+	setReadDeadline(t time.Time) error
+	close() error
+}
+
+// state holds data and incoming messages handling which
+// are shared by TCP, UDP and WebSocket clients.
+type state struct {
+	presence
+	// transport is set by the client once connection is dialed.
+	transport transport
+	opts      options
+	userID    int
+	// loggedIn is true after server accepted login, or after login
+	// request was sent if server does not confirm logins.
+	loggedIn bool
+	// confirmLogin is true if server replies to login with
+	// login accepted or error message.
+	confirmLogin bool
+	// loginDone is set once server replied to login,
+	// loginErr holds the error if login was rejected.
+	loginDone bool
+	loginErr  error
+	// codec is negotiated during handshake, JSON is used until then.
+	codec types.Codec
+	// session is issued by the server during handshake
+	// and proves that pings are sent by this client.
+	session string
+	// sessionID is issued to UDP clients which prefix datagrams with
+	// it, so server recognizes them after their address changes.
+	sessionID uint64
+	// key is sent in hello if client asks for sealed
+	// datagrams, secure is set once server agrees.
+	key    *ecdh.PrivateKey
+	secure *secure.Session
+	// received drops retransmitted duplicates
+	// of already handled sequenced messages.
+	received types.SeqWindow
+	errs     chan error
+}
+
+func newState(opts []Option) state {
+	o := newOptions(opts)
+	return state{
+		opts:  o,
+		codec: types.JSON,
+		// Legacy newline clients get all features from the server.
+		confirmLogin: o.lineProtocol,
+		errs:         make(chan error, errorsBufferSize),
+	}
+}
+
+// Errors returns channel with errors replied by the server.
+// Errors are dropped if nobody reads them and the buffer is full.
+func (s *state) Errors() <-chan error {
+	return s.errs
+}
+
+// encode encodes given command and struct using configured framing.
+func (s *state) encode(cmd types.CommandType, v interface{}) ([]byte, error) {
+	if s.opts.lineProtocol {
+		return types.EncodeMsg(cmd, v)
+	}
+	return types.EncodeFrame(s.codec, cmd, v)
+}
+
+// unmarshal decodes message payload sent by the server.
+func (s *state) unmarshal(data []byte, v interface{}) error {
+	if s.opts.lineProtocol {
+		return types.JSON.Unmarshal(data, v)
+	}
+	return s.codec.Unmarshal(data, v)
+}
+
+// hello returns handshake request advertising client capabilities.
+func (s *state) hello() *types.HelloRequest {
+	req := &types.HelloRequest{
+		Version:  types.ProtocolVersion,
+		Codecs:   []string{s.opts.codec.Name()},
+		Features: types.Features,
+	}
+	if s.opts.codec != types.JSON {
+		req.Codecs = append(req.Codecs, types.JSON.Name())
+	}
+	if s.opts.compression != "" {
+		req.Compressions = []string{s.opts.compression}
+	}
+	if s.key != nil {
+		req.PublicKey = s.key.PublicKey().Bytes()
+	}
+	return req
+}
+
+// welcome applies capabilities chosen by the server.
+func (s *state) welcome(msg *types.Msg) error {
+	if msg.Cmd != types.CmdWelcome {
+		return fmt.Errorf("expected hello reply, got command %d", msg.Cmd)
+	}
+	reply := new(types.HelloReply)
+	if err := types.JSON.Unmarshal(msg.Data, reply); err != nil {
+		return fmt.Errorf("could not parse hello reply: %v", err)
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("server (version %d) rejected handshake: %s", reply.Version, reply.Reason)
+	}
+
+	codec, err := types.CodecByName(reply.Codec)
+	if err != nil {
+		return err
+	}
+	if s.codec, err = types.Compress(codec, reply.Compression); err != nil {
+		return err
+	}
+	s.session = reply.Session
+	s.sessionID = reply.SessionID
+	s.confirmLogin = false
+	for _, f := range reply.Features {
+		if f == types.FeatureLoginAccepted {
+			s.confirmLogin = true
+		}
+	}
+	if s.key != nil {
+		if len(reply.PublicKey) == 0 {
+			return fmt.Errorf("server does not support encryption")
+		}
+		if s.secure, err = secure.NewSession(s.key, reply.PublicKey, false); err != nil {
+			return fmt.Errorf("could not agree on keys: %v", err)
+		}
+	}
+	logrus.Infof("handshake completed: codec=%s features=%v", s.codec.Name(), reply.Features)
+	return nil
+}
+
+// connect performs handshake unless line protocol is used and logs
+// user in over dialed connection. Requests are sent given number of
+// attempts as datagrams may be lost, stream transports use one.
+func (s *state) connect(user string, attempts int) error {
+	if !s.opts.lineProtocol {
+		if err := s.handshake(attempts); err != nil {
+			return err
+		}
+	}
+
+	req := &types.LoginRequest{}
+	r := strings.NewReader(user)
+	if err := json.NewDecoder(r).Decode(&req); err != nil {
+		return fmt.Errorf("invalid user login payload: %v", err)
+	}
+
+	s.userID = req.UserID
+	if err := s.login(req, attempts); err != nil {
+		return err
+	}
+	s.loggedIn = true
+	logrus.Infof("user %d connected to the game\n", s.userID)
+	return nil
+}
+
+// handshake sends hello and waits for the server to choose capabilities.
+// Hello is resent if reply does not arrive in time.
+func (s *state) handshake(attempts int) error {
+	defer s.transport.setReadDeadline(time.Time{})
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if err := s.transport.sendMessage(types.CmdHello, s.hello()); err != nil {
+			return fmt.Errorf("could not send hello: %v", err)
+		}
+
+		if err := s.transport.setReadDeadline(time.Now().Add(handshakeTimeout / time.Duration(attempts))); err != nil {
+			return err
+		}
+		msg, err := s.transport.readMessage()
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not read hello reply: %v", err)
+		}
+		return s.welcome(msg)
+	}
+	return fmt.Errorf("server did not reply to hello in %s", handshakeTimeout)
+}
+
+// login sends login request and waits until server accepts or rejects
+// it. Login is resent if reply does not arrive in time, server ignores
+// logins repeated from the same client.
+func (s *state) login(req *types.LoginRequest, attempts int) error {
+	if !s.confirmLogin {
+		// Server does not confirm logins, so we could only
+		// hope that the datagram was not lost.
+		if err := s.transport.sendMessage(types.CmdLogin, req); err != nil {
+			return fmt.Errorf("could send data: %v", err)
+		}
+		return nil
+	}
+
+	defer s.transport.setReadDeadline(time.Time{})
+	for attempt := 0; attempt < attempts; attempt++ {
+		if err := s.transport.sendMessage(types.CmdLogin, req); err != nil {
+			return fmt.Errorf("could send data: %v", err)
+		}
+
+		if err := s.transport.setReadDeadline(time.Now().Add(loginTimeout / time.Duration(attempts))); err != nil {
+			return err
+		}
+		for !s.loginDone {
+			msg, err := s.transport.readMessage()
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("could not read login reply: %v", err)
+			}
+			s.handleMsg(msg)
+		}
+		if s.loginDone {
+			return s.loginErr
+		}
+	}
+	return fmt.Errorf("server did not accept login in %s", loginTimeout)
+}
+
+// Close logs user out and closes connection. Logout is best-effort,
+// server would notice closed connection or missing pings anyway.
+func (s *state) Close() error {
+	if s.transport == nil {
+		return nil
+	}
+	if s.loggedIn {
+		if err := s.transport.sendMessage(types.CmdLogout, &types.LogoutRequest{UserID: s.userID}); err != nil {
+			logrus.Errorf("could not send logout: %v", err)
+		}
+	}
+	return s.transport.close()
+}
+
+func (s *state) ListenIncoming() {
+	for {
+		msg, err := s.transport.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				logrus.Errorf("could not read message: %v", err)
+			}
+			return
+		}
+
+		s.handleMsg(msg)
+	}
+}
+
+func (s *state) SetPresence(presence types.Presence, message string) error {
+	req := &types.SetPresenceRequest{UserID: s.userID, Presence: presence, Message: message}
+	return s.transport.sendMessage(types.CmdSetPresence, req)
+}
+
+func (s *state) QueryLastSeen(friends ...int) error {
+	return s.transport.sendMessage(types.CmdLastSeen, &types.LastSeenRequest{UserID: s.userID, Friends: friends})
+}
+
+func (s *state) PingLoop() {
+	for {
+		time.Sleep(pingInterval)
+		err := s.transport.sendMessage(types.CmdPing, s.ping())
+		if err != nil {
+			logrus.Errorf("could not ping server: %v", err)
+		}
+	}
+}
+
+// ping returns ping request of logged in user.
+func (s *state) ping() *types.PingRequest {
+	return &types.PingRequest{UserID: s.userID, Session: s.session}
+}
+
+// handleMsg handles single message received from the server.
+func (s *state) handleMsg(msg *types.Msg) {
+	if msg.Cmd == types.CmdSequenced {
+		s.handleSequenced(msg)
+		return
+	}
+	s.handleSeqMsg(msg, 0)
+}
+
+// handleSequenced acknowledges message and handles it unless it is
+// a duplicate. Duplicates are acknowledged too as ack could be lost.
+func (s *state) handleSequenced(msg *types.Msg) {
+	seq, inner, err := types.DecodeSequenced(msg.Data)
+	if err != nil {
+		logrus.Errorf("could not decode sequenced message: %v", err)
+		return
+	}
+	if err := s.transport.sendMessage(types.CmdAck, &types.AckRequest{Seq: seq}); err != nil {
+		logrus.Errorf("could not acknowledge message %d: %v", seq, err)
+	}
+	if !s.received.Check(seq) {
+		return
+	}
+	s.received.Update(seq)
+	s.handleSeqMsg(inner, seq)
+}
+
+// handleSeqMsg handles message with given sequence number,
+// zero means message was not sequenced.
+func (s *state) handleSeqMsg(msg *types.Msg, seq uint64) {
+	switch msg.Cmd {
+	case types.CmdLoginAccepted:
+		reply := new(types.LoginAcceptedReply)
+		if err := s.unmarshal(msg.Data, reply); err != nil {
+			logrus.Errorf("could not parse login accepted reply: %v", err)
+			return
+		}
+		if s.loginDone {
+			// Reply to a resent login.
+			return
+		}
+		logrus.Infof("login accepted: %+v", *reply)
+		s.loginDone = true
+	case types.CmdStatusChange:
+		status := new(types.StatusChangeReply)
+		if err := s.unmarshal(msg.Data, status); err != nil {
+			logrus.Errorf("could not parse status change: %v", err)
+			return
+		}
+		logrus.Infof("friend status changed: %+v", *status)
+		s.setStatus(status, seq)
+	case types.CmdPresenceSnapshot:
+		snapshot := new(types.PresenceSnapshotReply)
+		if err := s.unmarshal(msg.Data, snapshot); err != nil {
+			logrus.Errorf("could not parse presence snapshot: %v", err)
+			return
+		}
+		logrus.Infof("friends presence: %+v", snapshot.Friends)
+		s.setSnapshot(snapshot, seq)
+	case types.CmdLastSeenReply:
+		reply := new(types.LastSeenReply)
+		if err := s.unmarshal(msg.Data, reply); err != nil {
+			logrus.Errorf("could not parse last seen reply: %v", err)
+			return
+		}
+		logrus.Infof("friends last seen: %+v", reply.Friends)
+		for i := range reply.Friends {
+			s.setStatus(&reply.Friends[i], seq)
+		}
+	case types.CmdGoingAway:
+		reply := new(types.GoingAwayReply)
+		if err := s.unmarshal(msg.Data, reply); err != nil {
+			logrus.Errorf("could not parse going away message: %v", err)
+			return
+		}
+		logrus.Infof("server is going away: %s", reply.Reason)
+		s.setAllOffline()
+	case types.CmdKicked:
+		reply := new(types.KickedReply)
+		if err := s.unmarshal(msg.Data, reply); err != nil {
+			logrus.Errorf("could not parse kicked message: %v", err)
+			return
+		}
+		logrus.Infof("kicked out by server: %s", reply.Reason)
+		s.setAllOffline()
+	case types.CmdError:
+		reply := new(types.ErrorReply)
+		if err := s.unmarshal(msg.Data, reply); err != nil {
+			logrus.Errorf("could not parse error reply: %v", err)
+			return
+		}
+		if reply.Cmd == types.CmdLogin && s.confirmLogin && !s.loginDone {
+			s.loginDone = true
+			s.loginErr = reply
+			return
+		}
+		select {
+		case s.errs <- reply:
+		default:
+			logrus.Errorf("dropped server error: %v", reply)
+		}
+	}
+}
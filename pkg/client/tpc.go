@@ -2,88 +2,79 @@ package client
 
 import (
 	"bufio"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
-	"strings"
 	"time"
 
 	"github.com/anjmao/friends/pkg/types"
-	"github.com/sirupsen/logrus"
 )
 
-const (
-	tcpPingInterval = 100 * time.Millisecond
-)
-
-func NewTCPClient() Friends {
-	return &TCPClient{}
+func NewTCPClient(opts ...Option) Friends {
+	return &TCPClient{state: newState(opts)}
 }
 
 // TCPClient implements Friends using TCP protocol.
 type TCPClient struct {
-	conn   net.Conn
-	userID int
+	state
+	conn net.Conn
+	// next reads messages using configured framing, frames are
+	// read with decoder created before handshake.
+	next func() (*types.Msg, error)
 }
 
 func (c *TCPClient) Connect(addr, user string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := c.dial(addr)
 	if err != nil {
 		return fmt.Errorf("could open %s connection on addr %s: %v", "tcp", addr, err)
 	}
 	c.conn = conn
-
-	req := &types.LoginRequest{}
-	r := strings.NewReader(user)
-	if err := json.NewDecoder(r).Decode(&req); err != nil {
-		return fmt.Errorf("invalid user login payload: %v", err)
+	c.next = c.lineReader()
+	if !c.opts.lineProtocol {
+		c.next = types.NewDecoder(conn).Decode
 	}
-
-	if err := c.sendMessage(types.CmdLogin, req); err != nil {
-		return fmt.Errorf("could send data: %v", err)
-	}
-	c.userID = req.UserID
-	logrus.Infof("user %d connected to the game\n", c.userID)
-	return nil
+	c.transport = c
+	return c.connect(user, 1)
 }
 
-func (c *TCPClient) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+func (c *TCPClient) dial(addr string) (net.Conn, error) {
+	if c.opts.tls != nil {
+		return tls.Dial("tcp", addr, c.opts.tls)
 	}
-	return nil
+	return net.Dial("tcp", addr)
 }
 
-func (c *TCPClient) ListenIncoming() {
+func (c *TCPClient) lineReader() func() (*types.Msg, error) {
 	scanner := bufio.NewScanner(c.conn)
-	for {
+	return func() (*types.Msg, error) {
 		if ok := scanner.Scan(); !ok {
-			return
-		}
-
-		msg := types.DecodeMsg(scanner.Bytes())
-		switch msg.Cmd {
-		case types.CmdStatusChange:
-			logrus.Infof("friend status changed: %s", msg.Data)
+			if err := scanner.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
 		}
+		return types.DecodeMsg(scanner.Bytes()), nil
 	}
 }
 
-func (c *TCPClient) PingLoop() {
-	for {
-		time.Sleep(tcpPingInterval)
-		err := c.sendMessage(types.CmdPing, &types.PingRequest{UserID: c.userID})
-		if err != nil {
-			logrus.Errorf("could not ping server: %v", err)
-		}
-	}
+func (c *TCPClient) readMessage() (*types.Msg, error) {
+	return c.next()
 }
 
 func (c *TCPClient) sendMessage(cmd types.CommandType, v interface{}) error {
-	msg, err := types.EncodeMsg(cmd, v)
+	msg, err := c.encode(cmd, v)
 	if err != nil {
 		return err
 	}
 	_, err = c.conn.Write(msg)
 	return err
 }
+
+func (c *TCPClient) setReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *TCPClient) close() error {
+	return c.conn.Close()
+}
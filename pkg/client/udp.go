@@ -1,33 +1,45 @@
 package client
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
-	"strings"
 	"time"
 
+	"github.com/anjmao/friends/pkg/secure"
 	"github.com/anjmao/friends/pkg/types"
 
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	updPingInterval = 100 * time.Millisecond
-	udpBufferSize   = 65507
+	udpBufferSize = 65507
+	// udpAttempts is how many times hello and login
+	// are sent before giving up, datagrams may be lost.
+	udpAttempts = 3
 )
 
-func NewUDPClient() Friends {
-	return &UDPClient{}
+func NewUDPClient(opts ...Option) Friends {
+	return &UDPClient{state: newState(opts)}
 }
 
 // UDPClient implements Friends using UDP protocol.
 type UDPClient struct {
-	conn   *net.UDPConn
-	userID int
+	state
+	conn *net.UDPConn
 }
 
 func (c *UDPClient) Connect(addr, user string) error {
+	if c.opts.encryption {
+		if c.opts.lineProtocol {
+			return fmt.Errorf("encryption requires frames")
+		}
+		key, err := secure.GenerateKey()
+		if err != nil {
+			return err
+		}
+		c.key = key
+	}
+
 	raddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return err
@@ -38,67 +50,62 @@ func (c *UDPClient) Connect(addr, user string) error {
 		return err
 	}
 	c.conn = conn
-
-	req := &types.LoginRequest{}
-	r := strings.NewReader(user)
-	if err := json.NewDecoder(r).Decode(&req); err != nil {
-		return fmt.Errorf("invalid login payload: %v", err)
-	}
-
-	if err := c.sendMessage(types.CmdLogin, req); err != nil {
-		return fmt.Errorf("could send data: %v", err)
-	}
-
-	c.userID = req.UserID
-	// While for TCP client we know if request was sent successfully
-	// with UDP we could not be sure that packet was not lost.
-	// Ideally UDP client should listen to some ACK message before
-	// starting the game, but here we keep it simple and assume that
-	// client sent initial request and server got it.
-	fmt.Printf("user %d connected to the game\n", c.userID)
-	return nil
+	c.transport = c
+	return c.connect(user, udpAttempts)
 }
 
-func (c *UDPClient) ListenIncoming() {
+// readMessage reads datagrams until one of them is opened and decoded,
+// invalid datagrams are dropped.
+func (c *UDPClient) readMessage() (*types.Msg, error) {
+	buffer := make([]byte, udpBufferSize)
 	for {
-		buffer := make([]byte, udpBufferSize)
 		n, _, err := c.conn.ReadFromUDP(buffer)
 		if err != nil {
-			logrus.Errorf("could not read packet: %v", err)
-			return
+			return nil, err
 		}
 
-		msg := types.DecodeMsg(buffer[:n])
-
-		switch msg.Cmd {
-		case types.CmdStatusChange:
-			logrus.Infof("friend status changed: %s", msg.Data)
+		msg, err := c.decodePacket(buffer[:n])
+		if err != nil {
+			logrus.Errorf("could not decode packet: %v", err)
+			continue
 		}
+		return msg, nil
 	}
 }
 
-func (c *UDPClient) Close() error {
-	if c.conn == nil {
-		return c.conn.Close()
-	}
-	return nil
-}
-
-func (c *UDPClient) PingLoop() {
-	for {
-		time.Sleep(updPingInterval)
-		err := c.sendMessage(types.CmdPing, &types.PingRequest{UserID: c.userID})
-		if err != nil {
-			logrus.Errorf("could not ping server: %v", err)
+// decodePacket opens and decodes message from a single datagram.
+func (c *UDPClient) decodePacket(b []byte) (*types.Msg, error) {
+	if c.secure != nil {
+		var err error
+		if b, err = c.secure.Open(b); err != nil {
+			return nil, fmt.Errorf("could not open packet: %v", err)
 		}
 	}
+	if types.IsFrame(b) {
+		return types.DecodeFrame(b)
+	}
+	return types.DecodeMsg(b), nil
 }
 
 func (c *UDPClient) sendMessage(cmd types.CommandType, v interface{}) error {
-	msg, err := types.EncodeMsg(cmd, v)
+	msg, err := c.encode(cmd, v)
 	if err != nil {
 		return err
 	}
+	if c.secure != nil {
+		msg = c.secure.Seal(msg)
+	}
+	if c.sessionID != 0 {
+		msg = types.EncodeSessionDatagram(c.sessionID, msg)
+	}
 	_, err = c.conn.Write(msg)
 	return err
 }
+
+func (c *UDPClient) setReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *UDPClient) close() error {
+	return c.conn.Close()
+}
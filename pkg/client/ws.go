@@ -0,0 +1,60 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+	"github.com/anjmao/friends/pkg/websocket"
+)
+
+// NewWSClient creates WebSocket client. It always performs handshake,
+// WithLineProtocol option is ignored.
+func NewWSClient(opts ...Option) Friends {
+	c := &WSClient{state: newState(opts)}
+	c.opts.lineProtocol = false
+	return c
+}
+
+// WSClient implements Friends using WebSocket protocol. It is mostly
+// useful to test the server as browsers connect to it directly.
+type WSClient struct {
+	state
+	conn *websocket.Conn
+}
+
+func (c *WSClient) Connect(addr, user string) error {
+	conn, err := websocket.Dial("ws://" + addr + "/")
+	if err != nil {
+		return fmt.Errorf("could open %s connection on addr %s: %v", "ws", addr, err)
+	}
+	c.conn = conn
+	c.transport = c
+	return c.connect(user, 1)
+}
+
+func (c *WSClient) readMessage() (*types.Msg, error) {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return types.DecodeMsg(data), nil
+}
+
+// sendMessage sends command as a single WebSocket message. Messages
+// don't need frame header as WebSocket keeps them apart.
+func (c *WSClient) sendMessage(cmd types.CommandType, v interface{}) error {
+	msg, err := types.EncodeMessage(c.codec, cmd, v)
+	if err != nil {
+		return err
+	}
+	return c.conn.WriteMessage(websocket.OpBinary, msg)
+}
+
+func (c *WSClient) setReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSClient) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,134 @@
+// Package secure seals UDP datagrams with AES-GCM. Keys are agreed
+// using X25519 during hello handshake, so each client session has
+// its own keys.
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// packetMagic is the first byte of sealed datagrams. It differs from
+// frame magic, so sealed and plain datagrams can't be mixed up.
+const packetMagic = 0xE1
+
+// headerSize is magic byte and big endian sequence number.
+const headerSize = 1 + 8
+
+var (
+	// ErrInvalidPacket is returned for datagrams which are not
+	// sealed or could not be authenticated.
+	ErrInvalidPacket = errors.New("secure: invalid packet")
+	// ErrReplay is returned for datagrams which were already
+	// received or are too old to tell.
+	ErrReplay = errors.New("secure: replayed packet")
+)
+
+// GenerateKey generates X25519 key sent to the peer during handshake.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// IsSealed reports whether datagram is sealed.
+func IsSealed(b []byte) bool {
+	return len(b) > 0 && b[0] == packetMagic
+}
+
+// Session seals outgoing and opens incoming datagrams of one client.
+// Seal could be called concurrently, Open must be called from a
+// single goroutine which reads datagrams.
+type Session struct {
+	seal    cipher.AEAD
+	open    cipher.AEAD
+	sendSeq atomic.Uint64
+	window  types.SeqWindow
+}
+
+// NewSession agrees on session keys with the peer's public key.
+// Client and server use different keys for each direction, so
+// server must be true on the server side only.
+func NewSession(key *ecdh.PrivateKey, peerKey []byte, server bool) (*Session, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, serverKey := peerKey, key.PublicKey().Bytes()
+	if !server {
+		clientKey, serverKey = serverKey, clientKey
+	}
+	salt := append(append([]byte{}, clientKey...), serverKey...)
+	toServer, err := newAEAD(secret, salt, "friends client to server")
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newAEAD(secret, salt, "friends server to client")
+	if err != nil {
+		return nil, err
+	}
+
+	if server {
+		return &Session{seal: toClient, open: toServer}, nil
+	}
+	return &Session{seal: toServer, open: toClient}, nil
+}
+
+func newAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts datagram. Sequence number is sent in clear and
+// used as a nonce, so it is never reused with the same key.
+func (s *Session) Seal(b []byte) []byte {
+	seq := s.sendSeq.Add(1) - 1
+	out := make([]byte, headerSize, headerSize+len(b)+s.seal.Overhead())
+	out[0] = packetMagic
+	binary.BigEndian.PutUint64(out[1:headerSize], seq)
+	return s.seal.Seal(out, nonce(seq), b, out[:headerSize])
+}
+
+// Open authenticates and decrypts datagram. Datagrams could arrive
+// out of order, but each of them is accepted only once.
+func (s *Session) Open(b []byte) ([]byte, error) {
+	if len(b) < headerSize || !IsSealed(b) {
+		return nil, ErrInvalidPacket
+	}
+	seq := binary.BigEndian.Uint64(b[1:headerSize])
+	if !s.window.Check(seq) {
+		return nil, ErrReplay
+	}
+	out, err := s.open.Open(nil, nonce(seq), b[headerSize:], b[:headerSize])
+	if err != nil {
+		return nil, ErrInvalidPacket
+	}
+	// Window is moved only by authentic datagrams.
+	s.window.Update(seq)
+	return out, nil
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
@@ -0,0 +1,114 @@
+package secure
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+func newSessions(t *testing.T) (client, server *Session) {
+	clientKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewSession(clientKey, serverKey.PublicKey().Bytes(), false)
+	if err != nil {
+		t.Fatalf("could not create client session: %v", err)
+	}
+	server, err = NewSession(serverKey, clientKey.PublicKey().Bytes(), true)
+	if err != nil {
+		t.Fatalf("could not create server session: %v", err)
+	}
+	return client, server
+}
+
+func TestSealOpen(t *testing.T) {
+	client, server := newSessions(t)
+	msg := []byte("hello")
+
+	sealed := client.Seal(msg)
+	if !IsSealed(sealed) || bytes.Contains(sealed, msg) {
+		t.Fatalf("expected sealed datagram, got %x", sealed)
+	}
+	out, err := server.Open(sealed)
+	if err != nil {
+		t.Fatalf("could not open datagram: %v", err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Errorf("expected %q, got %q", msg, out)
+	}
+
+	reply, err := client.Open(server.Seal(msg))
+	if err != nil || !bytes.Equal(reply, msg) {
+		t.Errorf("expected server datagram to be opened by client, got %q %v", reply, err)
+	}
+	// Directions use different keys.
+	if _, err := client.Open(client.Seal(msg)); err != ErrInvalidPacket {
+		t.Errorf("expected own datagram to be rejected, got %v", err)
+	}
+}
+
+func TestOpenRejectsTampered(t *testing.T) {
+	client, server := newSessions(t)
+	_, other := newSessions(t)
+
+	tampered := client.Seal([]byte("hello"))
+	tampered[len(tampered)-1] ^= 1
+	changedSeq := client.Seal([]byte("hello"))
+	changedSeq[8]++
+
+	for name, b := range map[string][]byte{
+		"tampered":     tampered,
+		"changed seq":  changedSeq,
+		"plain":        []byte("hello"),
+		"short":        {packetMagic, 1},
+		"another peer": client.Seal([]byte("hello")),
+	} {
+		s := server
+		if name == "another peer" {
+			s = other
+		}
+		if _, err := s.Open(b); err != ErrInvalidPacket {
+			t.Errorf("%s: expected invalid packet error, got %v", name, err)
+		}
+	}
+
+	// Rejected datagrams don't move replay window.
+	if _, err := server.Open(client.Seal([]byte("hello"))); err != nil {
+		t.Errorf("expected next datagram to be accepted, got %v", err)
+	}
+}
+
+func TestOpenRejectsReplays(t *testing.T) {
+	client, server := newSessions(t)
+	var packets [][]byte
+	for i := 0; i < types.SeqWindowSize+5; i++ {
+		packets = append(packets, client.Seal([]byte{byte(i)}))
+	}
+
+	// Out of order datagrams are accepted once.
+	for _, i := range []int{1, 0, 3, 2} {
+		if _, err := server.Open(packets[i]); err != nil {
+			t.Fatalf("expected datagram %d to be accepted, got %v", i, err)
+		}
+	}
+	if _, err := server.Open(packets[2]); err != ErrReplay {
+		t.Errorf("expected replayed datagram to be rejected, got %v", err)
+	}
+
+	if _, err := server.Open(packets[types.SeqWindowSize+4]); err != nil {
+		t.Fatalf("expected newest datagram to be accepted, got %v", err)
+	}
+	// Datagram 4 was not received, but it is too old now.
+	if _, err := server.Open(packets[4]); err != ErrReplay {
+		t.Errorf("expected datagram outside of window to be rejected, got %v", err)
+	}
+	if _, err := server.Open(packets[types.SeqWindowSize]); err != nil {
+		t.Errorf("expected datagram inside window to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for malformed tokens, tokens with
+	// a wrong signature or tokens issued for another user.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned for tokens used after their expiry.
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Authenticator verifies that login is sent by the user it claims to be.
+type Authenticator interface {
+	Authenticate(userID int, token string) error
+}
+
+// HMACAuthenticator verifies tokens signed with a shared secret. Token
+// has "<user id>.<expiry unix time>.<signature>" form where signature is
+// base64 encoded HMAC-SHA256 of the first two parts.
+type HMACAuthenticator struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// NewHMACAuthenticator creates authenticator which verifies
+// tokens signed with the given secret.
+func NewHMACAuthenticator(secret []byte) *HMACAuthenticator {
+	return &HMACAuthenticator{secret: secret, now: time.Now}
+}
+
+// Token signs token which is valid for the given user until expires.
+func (a *HMACAuthenticator) Token(userID int, expires time.Time) string {
+	payload := strconv.Itoa(userID) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sign(payload))
+}
+
+func (a *HMACAuthenticator) Authenticate(userID int, token string) error {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return ErrInvalidToken
+	}
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+		return ErrInvalidToken
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return ErrInvalidToken
+	}
+	tokenUserID, err := strconv.Atoi(parts[0])
+	if err != nil || tokenUserID != userID {
+		return ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if a.now().Unix() >= expires {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+func (a *HMACAuthenticator) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
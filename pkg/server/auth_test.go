@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHMACAuthenticator(t *testing.T) {
+	a := NewHMACAuthenticator([]byte("secret"))
+	now := time.Unix(1000, 0)
+	a.now = func() time.Time { return now }
+	token := a.Token(1, now.Add(time.Minute))
+	other := NewHMACAuthenticator([]byte("other")).Token(1, now.Add(time.Minute))
+
+	tests := []struct {
+		name     string
+		userID   int
+		token    string
+		expected error
+	}{
+		{name: "valid token", userID: 1, token: token},
+		{name: "another user", userID: 2, token: token, expected: ErrInvalidToken},
+		{name: "empty token", userID: 1, token: "", expected: ErrInvalidToken},
+		{name: "wrong secret", userID: 1, token: other, expected: ErrInvalidToken},
+		{name: "changed user", userID: 2, token: "2" + token[1:], expected: ErrInvalidToken},
+		{name: "bad signature encoding", userID: 1, token: token + "!", expected: ErrInvalidToken},
+		{name: "expired token", userID: 1, token: a.Token(1, now), expected: ErrTokenExpired},
+		{name: "extra parts", userID: 1, token: strings.Replace(token, ".", "..", 1), expected: ErrInvalidToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			if err := a.Authenticate(test.userID, test.token); err != test.expected {
+				tt.Errorf("expected error %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
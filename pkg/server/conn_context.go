@@ -1,9 +1,17 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net"
+	"sync"
 	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/anjmao/friends/pkg/secure"
+	"github.com/anjmao/friends/pkg/types"
+	"github.com/anjmao/friends/pkg/websocket"
 )
 
 const writeDeadline = 3 * time.Second
@@ -14,11 +22,122 @@ const writeDeadline = 3 * time.Second
 type ConnContext struct {
 	tcpConn net.Conn
 	udpConn net.PacketConn
-	addr    net.Addr
+	wsConn  *websocket.Conn
+	// mu guards addr which changes when UDP client moves
+	// to another address, e.g. after NAT rebinding.
+	mu   sync.Mutex
+	addr net.Addr
+	// lastSeen is when the last valid UDP datagram arrived,
+	// UDP server forgets idle clients.
+	lastSeen time.Time
+	// framed is true when client talks using length prefixed frames.
+	// Otherwise legacy newline terminated messages are used.
+	framed bool
+	// codec is used for framed connections payloads
+	// once handshake is completed.
+	codec types.Codec
+	// welcomed is true after successful hello handshake.
+	welcomed bool
+	welcome  *types.HelloReply
+	features map[string]bool
+	// secure seals UDP datagrams if client asked for
+	// encryption during handshake.
+	secure *secure.Session
+	// outbox retransmits UDP messages until client
+	// acknowledges them if it asked for reliable delivery.
+	outbox *outbox
+}
+
+// send encodes given command and struct using connection's
+// framing and writes it to the client.
+func (c *ConnContext) send(cmd types.CommandType, v interface{}) error {
+	return c.sendWith(c.payloadCodec(), cmd, v)
+}
+
+// ownsSession reports if given session token was issued to this
+// connection. Legacy clients which don't say hello have no session
+// and are identified by connection only.
+func (c *ConnContext) ownsSession(session string) bool {
+	if c.welcome == nil || c.welcome.Session == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(c.welcome.Session), []byte(session)) == 1
+}
+
+// sendError replies to the client with structured error
+// describing why given command could not be handled.
+func (c *ConnContext) sendError(cmd types.CommandType, code types.ErrorCode, err error) {
+	reply := &types.ErrorReply{Code: code, Message: err.Error(), Cmd: cmd}
+	if err := c.send(types.CmdError, reply); err != nil {
+		logrus.Errorf("could not send error reply: %v", err)
+	}
+}
+
+// sendWith is like send but uses given codec for framed connections.
+func (c *ConnContext) sendWith(codec types.Codec, cmd types.CommandType, v interface{}) error {
+	b, err := c.encode(codec, cmd, v)
+	if err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+// encode encodes given command and struct using connection's framing.
+func (c *ConnContext) encode(codec types.Codec, cmd types.CommandType, v interface{}) ([]byte, error) {
+	switch {
+	case c.wsConn != nil:
+		return types.EncodeMessage(codec, cmd, v)
+	case c.framed:
+		return types.EncodeFrame(codec, cmd, v)
+	default:
+		return types.EncodeMsg(cmd, v)
+	}
+}
+
+// unmarshal decodes message payload sent by the client.
+func (c *ConnContext) unmarshal(data []byte, v interface{}) error {
+	return c.payloadCodec().Unmarshal(data, v)
+}
+
+// supports reports whether feature was negotiated during handshake.
+// Legacy clients get all features they could safely ignore.
+func (c *ConnContext) supports(feature string) bool {
+	return !c.framed || c.features[feature]
 }
 
-// write writes data to underlying network connection.
+func (c *ConnContext) payloadCodec() types.Codec {
+	if !c.framed || c.codec == nil {
+		return types.JSON
+	}
+	return c.codec
+}
+
+// write writes data to underlying network connection. UDP
+// datagrams are sequenced and sealed if client negotiated it.
 func (c *ConnContext) write(b []byte) error {
+	if c.outbox != nil {
+		return c.outbox.send(b)
+	}
+	return c.writeSealed(b)
+}
+
+// writeSealed seals data if encryption was negotiated and writes it.
+func (c *ConnContext) writeSealed(b []byte) error {
+	if c.secure != nil {
+		b = c.secure.Seal(b)
+	}
+	return c.writePlain(b)
+}
+
+// writePlain writes data to underlying network connection as is.
+func (c *ConnContext) writePlain(b []byte) error {
+	if c.wsConn != nil {
+		if err := c.wsConn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
+			return fmt.Errorf("could not set write deadline: %v", err)
+		}
+		return c.wsConn.WriteMessage(websocket.OpBinary, b)
+	}
+
 	if c.tcpConn != nil {
 		if err := c.tcpConn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
 			return fmt.Errorf("could not set write deadline: %v", err)
@@ -30,14 +149,35 @@ func (c *ConnContext) write(b []byte) error {
 	if err := c.udpConn.SetWriteDeadline(time.Now().Add(writeDeadline)); err != nil {
 		return fmt.Errorf("could not set write deadline: %v", err)
 	}
-	_, err := c.udpConn.WriteTo(b, c.addr)
+	_, err := c.udpConn.WriteTo(b, c.remoteAddr())
 	return err
 }
 
-// close closes TCP connections. Does nothing for UDP.
+// remoteAddr returns current address of UDP client.
+func (c *ConnContext) remoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addr
+}
+
+// setRemoteAddr changes address further UDP datagrams are sent to.
+func (c *ConnContext) setRemoteAddr(addr net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addr = addr
+}
+
+// close closes TCP and WebSocket connections. UDP has no
+// connection, only pending retransmissions are dropped.
 func (c *ConnContext) close() error {
+	if c.wsConn != nil {
+		return c.wsConn.Close()
+	}
 	if c.tcpConn != nil {
 		return c.tcpConn.Close()
 	}
+	if c.outbox != nil {
+		c.outbox.stop()
+	}
 	return nil
 }
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// FriendGraph owns friendships on the server side so clients
+// can't subscribe to presence of users who are not their friends.
+type FriendGraph interface {
+	// Friends returns IDs of users whose presence given user may see.
+	// Unknown users have no friends.
+	Friends(userID int) ([]int, error)
+}
+
+// NewMemoryGraph creates friend graph from user ID to friends list map.
+func NewMemoryGraph(friends map[int][]int) *MemoryGraph {
+	g := &MemoryGraph{friends: make(map[int][]int, len(friends))}
+	for userID, list := range friends {
+		g.SetFriends(userID, list)
+	}
+	return g
+}
+
+// MemoryGraph keeps friend graph in memory. It is safe for concurrent use.
+type MemoryGraph struct {
+	mu      sync.RWMutex
+	friends map[int][]int
+}
+
+// Friends returns a copy of user's friends list.
+func (g *MemoryGraph) Friends(userID int) ([]int, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return append([]int(nil), g.friends[userID]...), nil
+}
+
+// SetFriends replaces user's friends list.
+func (g *MemoryGraph) SetFriends(userID int, friends []int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.friends[userID] = append([]int(nil), friends...)
+}
+
+// NewFileGraph loads friend graph from JSON file which maps
+// user IDs to friends lists, e.g. {"1": [2, 3], "2": [1]}.
+func NewFileGraph(path string) (*FileGraph, error) {
+	g := &FileGraph{path: path, MemoryGraph: NewMemoryGraph(nil)}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// FileGraph is a friend graph loaded from JSON file.
+type FileGraph struct {
+	*MemoryGraph
+	path string
+}
+
+// Reload reads the file again and replaces whole graph. Graph is
+// left unchanged if file can't be read.
+func (g *FileGraph) Reload() error {
+	b, err := os.ReadFile(g.path)
+	if err != nil {
+		return fmt.Errorf("could not read friend graph: %v", err)
+	}
+	friends := make(map[int][]int)
+	if err := json.Unmarshal(b, &friends); err != nil {
+		return fmt.Errorf("could not parse friend graph %s: %v", g.path, err)
+	}
+
+	g.mu.Lock()
+	g.friends = friends
+	g.mu.Unlock()
+	return nil
+}
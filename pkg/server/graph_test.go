@@ -0,0 +1,68 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryGraph(t *testing.T) {
+	g := NewMemoryGraph(map[int][]int{1: {2, 3}})
+
+	friends, _ := g.Friends(1)
+	if !reflect.DeepEqual(friends, []int{2, 3}) {
+		t.Fatalf("expected friends [2 3], got %v", friends)
+	}
+	friends[0] = 5
+	if friends, _ := g.Friends(1); friends[0] != 2 {
+		t.Fatal("expected graph not to be changed through returned slice")
+	}
+
+	g.SetFriends(1, []int{4})
+	if friends, _ := g.Friends(1); !reflect.DeepEqual(friends, []int{4}) {
+		t.Fatalf("expected friends [4], got %v", friends)
+	}
+	if friends, err := g.Friends(7); err != nil || len(friends) != 0 {
+		t.Fatalf("expected no friends for unknown user, got %v %v", friends, err)
+	}
+}
+
+func TestFileGraph(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "friends.json")
+	if err := os.WriteFile(path, []byte(`{"1": [2, 3], "2": [1]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewFileGraph(path)
+	if err != nil {
+		t.Fatalf("could not load graph: %v", err)
+	}
+	if friends, _ := g.Friends(1); !reflect.DeepEqual(friends, []int{2, 3}) {
+		t.Fatalf("expected friends [2 3], got %v", friends)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"1": [2]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(); err != nil {
+		t.Fatalf("could not reload graph: %v", err)
+	}
+	if friends, _ := g.Friends(1); !reflect.DeepEqual(friends, []int{2}) {
+		t.Fatalf("expected friends [2] after reload, got %v", friends)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"1": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Reload(); err == nil {
+		t.Fatal("expected error for invalid file")
+	}
+	if friends, _ := g.Friends(1); !reflect.DeepEqual(friends, []int{2}) {
+		t.Fatalf("expected graph to be kept after failed reload, got %v", friends)
+	}
+
+	if _, err := NewFileGraph(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
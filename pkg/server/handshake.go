@@ -0,0 +1,170 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/anjmao/friends/pkg/secure"
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// dispatch handles hello handshake for framed connections and passes
+// all other messages to the handler. Framed clients must complete
+// handshake before any other message is accepted, while legacy newline
+// clients don't know about handshake and are served as version 0.
+func dispatch(ctx *ConnContext, msg *types.Msg, o options, handler ConnHandler) {
+	if !ctx.framed {
+		handler(ctx, msg)
+		return
+	}
+
+	if msg.Cmd == types.CmdHello {
+		handleHello(ctx, msg, o)
+		return
+	}
+
+	if !ctx.welcomed {
+		err := fmt.Errorf("command %d received before handshake", msg.Cmd)
+		logrus.Error(err)
+		ctx.sendError(msg.Cmd, types.ErrCodeHandshakeRequired, err)
+		return
+	}
+	handler(ctx, msg)
+}
+
+func handleHello(ctx *ConnContext, msg *types.Msg, o options) {
+	req := new(types.HelloRequest)
+	if err := types.JSON.Unmarshal(msg.Data, req); err != nil {
+		logrus.Errorf("could not parse hello message: %v", err)
+		reject(ctx, "invalid hello message")
+		return
+	}
+
+	if ctx.welcomed {
+		// Client retries hello because our reply was lost,
+		// answer with the same capabilities again.
+		sendWelcome(ctx, ctx.welcome)
+		return
+	}
+
+	reply := negotiate(req, o)
+	if !reply.Accepted {
+		reject(ctx, reply.Reason)
+		return
+	}
+	reply.Session = rand.Text()
+	if ctx.udpConn != nil {
+		reply.SessionID = newSessionID()
+	}
+
+	// Only UDP datagrams are sealed, TCP could use TLS instead.
+	var session *secure.Session
+	if ctx.udpConn != nil && len(req.PublicKey) > 0 {
+		key, err := secure.GenerateKey()
+		if err == nil {
+			session, err = secure.NewSession(key, req.PublicKey, true)
+		}
+		if err != nil {
+			logrus.Errorf("could not agree on keys: %v", err)
+			reject(ctx, "invalid public key")
+			return
+		}
+		reply.PublicKey = key.PublicKey().Bytes()
+	} else if ctx.udpConn != nil && o.requireEncryption {
+		reject(ctx, "encryption required")
+		return
+	}
+	if err := sendWelcome(ctx, reply); err != nil {
+		return
+	}
+
+	// Negotiated codec is used starting from the next message.
+	codec, _ := types.CodecByName(reply.Codec)
+	ctx.codec, _ = types.Compress(codec, reply.Compression)
+	ctx.features = make(map[string]bool, len(reply.Features))
+	for _, f := range reply.Features {
+		ctx.features[f] = true
+	}
+	ctx.secure = session
+	if ctx.udpConn != nil && ctx.features[types.FeatureReliableDelivery] {
+		ctx.outbox = newOutbox(ctx)
+	}
+	ctx.welcome = reply
+	ctx.welcomed = true
+}
+
+// newSessionID returns random non zero ID of UDP session.
+func newSessionID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id
+		}
+	}
+}
+
+// negotiate chooses capabilities supported by both sides. Codec is
+// chosen by server preference, compression by client preference.
+func negotiate(req *types.HelloRequest, o options) *types.HelloReply {
+	reply := &types.HelloReply{Version: types.ProtocolVersion}
+	if req.Version != types.ProtocolVersion {
+		reply.Reason = "unsupported protocol version"
+		return reply
+	}
+
+	clientCodecs := make(map[string]bool, len(req.Codecs))
+	for _, name := range req.Codecs {
+		clientCodecs[name] = true
+	}
+	for _, c := range []types.Codec{o.codec, types.JSON, types.Binary} {
+		if clientCodecs[c.Name()] {
+			reply.Codec = c.Name()
+			break
+		}
+	}
+	if reply.Codec == "" {
+		reply.Reason = "no supported codec"
+		return reply
+	}
+
+	reply.Compression = types.CompressionNone
+	for _, name := range req.Compressions {
+		if _, err := types.Compress(types.JSON, name); err == nil {
+			reply.Compression = name
+			break
+		}
+	}
+
+	for _, f := range req.Features {
+		for _, known := range types.Features {
+			if f == known {
+				reply.Features = append(reply.Features, f)
+				break
+			}
+		}
+	}
+
+	reply.Accepted = true
+	return reply
+}
+
+func reject(ctx *ConnContext, reason string) {
+	sendWelcome(ctx, &types.HelloReply{Version: types.ProtocolVersion, Reason: reason})
+}
+
+// sendWelcome sends hello reply which is always encoded as JSON
+// and never sealed, so client could agree on keys.
+func sendWelcome(ctx *ConnContext, reply *types.HelloReply) error {
+	b, err := ctx.encode(types.JSON, types.CmdWelcome, reply)
+	if err == nil {
+		err = ctx.writePlain(b)
+	}
+	if err != nil {
+		logrus.Errorf("could not send hello reply: %v", err)
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		codec    types.Codec
+		req      *types.HelloRequest
+		expected *types.HelloReply
+	}{
+		{
+			name:  "server codec preferred",
+			codec: types.Binary,
+			req: &types.HelloRequest{
+				Version:      types.ProtocolVersion,
+				Codecs:       []string{"json", "binary"},
+				Compressions: []string{"lz4", "deflate"},
+				Features:     []string{types.FeaturePresenceSnapshot, "unknown"},
+			},
+			expected: &types.HelloReply{
+				Accepted:    true,
+				Version:     types.ProtocolVersion,
+				Codec:       "binary",
+				Compression: "deflate",
+				Features:    []string{types.FeaturePresenceSnapshot},
+			},
+		},
+		{
+			name:  "fallback to client codec",
+			codec: types.Binary,
+			req:   &types.HelloRequest{Version: types.ProtocolVersion, Codecs: []string{"json"}},
+			expected: &types.HelloReply{
+				Accepted:    true,
+				Version:     types.ProtocolVersion,
+				Codec:       "json",
+				Compression: "none",
+			},
+		},
+		{
+			name:  "unsupported version",
+			codec: types.JSON,
+			req:   &types.HelloRequest{Version: 99, Codecs: []string{"json"}},
+			expected: &types.HelloReply{
+				Version: types.ProtocolVersion,
+				Reason:  "unsupported protocol version",
+			},
+		},
+		{
+			name:  "no common codec",
+			codec: types.JSON,
+			req:   &types.HelloRequest{Version: types.ProtocolVersion, Codecs: []string{"xml"}},
+			expected: &types.HelloReply{
+				Version: types.ProtocolVersion,
+				Reason:  "no supported codec",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			reply := negotiate(test.req, newOptions([]Option{WithCodec(test.codec)}))
+			if !reflect.DeepEqual(reply, test.expected) {
+				tt.Fatalf("expected %+v, got %+v", test.expected, reply)
+			}
+		})
+	}
+}
+
+func TestDispatchRequiresHelloForFramedClients(t *testing.T) {
+	ctx := createConnContext()
+	ctx.framed = true
+	var handled []*types.Msg
+	handler := func(ctx *ConnContext, msg *types.Msg) {
+		handled = append(handled, msg)
+	}
+	o := newOptions([]Option{WithCodec(types.Binary)})
+
+	login := &types.Msg{Cmd: types.CmdLogin, Data: []byte("{\"user_id\":1}")}
+	dispatch(ctx, login, o, handler)
+	if len(handled) != 0 {
+		t.Fatal("expected login before hello to be rejected")
+	}
+
+	hello, _ := types.JSON.Marshal(&types.HelloRequest{
+		Version: types.ProtocolVersion,
+		Codecs:  []string{"binary", "json"},
+	})
+	dispatch(ctx, &types.Msg{Cmd: types.CmdHello, Data: hello}, o, handler)
+	if !ctx.welcomed || ctx.codec != types.Binary {
+		t.Fatalf("expected binary codec to be negotiated, got %v", ctx.codec)
+	}
+
+	dispatch(ctx, login, o, handler)
+	if len(handled) != 1 {
+		t.Fatal("expected login after hello to be handled")
+	}
+
+	msgs := writtenMsgs(ctx)
+	if len(msgs) != 2 {
+		t.Fatalf("expected error and welcome replies, got %v", msgs)
+	}
+	errReply := new(types.ErrorReply)
+	if err := types.JSON.Unmarshal(msgs[0].Data, errReply); err != nil {
+		t.Fatalf("could not parse error reply: %v", err)
+	}
+	if msgs[0].Cmd != types.CmdError || errReply.Code != types.ErrCodeHandshakeRequired || errReply.Cmd != types.CmdLogin {
+		t.Errorf("expected handshake required error, got %+v", errReply)
+	}
+	reply := new(types.HelloReply)
+	if err := types.JSON.Unmarshal(msgs[1].Data, reply); err != nil {
+		t.Fatalf("could not parse hello reply: %v", err)
+	}
+	if msgs[1].Cmd != types.CmdWelcome || !reply.Accepted {
+		t.Errorf("expected accepted hello reply, got %+v", reply)
+	}
+	if reply.Session == "" || !ctx.ownsSession(reply.Session) || ctx.ownsSession("") {
+		t.Errorf("expected connection to own issued session %q", reply.Session)
+	}
+	if reply.SessionID != 0 {
+		t.Errorf("expected session ID to be issued only to UDP clients, got %d", reply.SessionID)
+	}
+}
+
+func TestDispatchLegacyClientsWithoutHello(t *testing.T) {
+	ctx := createConnContext()
+	handled := false
+	handler := func(ctx *ConnContext, msg *types.Msg) {
+		handled = true
+	}
+
+	dispatch(ctx, &types.Msg{Cmd: types.CmdLogin}, newOptions(nil), handler)
+	if !handled {
+		t.Fatal("expected legacy client login to be handled")
+	}
+	if !ctx.supports(types.FeaturePresenceSnapshot) {
+		t.Fatal("expected legacy client to get presence snapshots")
+	}
+}
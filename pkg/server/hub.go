@@ -1,8 +1,11 @@
 package server
 
 import (
-	"encoding/json"
+	"container/heap"
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,8 +19,15 @@ const (
 )
 
 type ping struct {
+	userID  int
+	session string
+	time    time.Time
+	conn    *ConnContext
+}
+
+type userLogout struct {
 	userID int
-	time   time.Time
+	conn   *ConnContext
 }
 
 type userLogin struct {
@@ -25,32 +35,89 @@ type userLogin struct {
 	conn *ConnContext
 }
 
+type presenceChange struct {
+	req  *types.SetPresenceRequest
+	conn *ConnContext
+}
+
+type lastSeenQuery struct {
+	req  *types.LastSeenRequest
+	conn *ConnContext
+}
+
+// seen is the time user was visible online the last time and his
+// friends list at that time. Friends lists of offline users are not
+// known otherwise, but they decide who may see the last seen time.
+type seen struct {
+	time    time.Time
+	friends []int
+}
+
 type User struct {
 	UserID int
 	Online bool
-	// Since we are sending users friends array from the client
-	// for simplicity we store friends as int array, but in real world scenario
-	// map[int]User, linkedList or bitmap would be a better data structure as
-	// all friends could be already got from the server side.
-	Friends      []int
-	Conn         *ConnContext
-	LastPingTime time.Time
+	// Friends are resolved from the friend graph if hub has one,
+	// otherwise friends list sent by the client is used. Latest login
+	// defines friends of a user with multiple sessions. Friends are
+	// sorted, they are the watchers of user's status and are searched
+	// to find out if user lists someone.
+	Friends []int
+	// Sessions are user's connections. Friends are notified when
+	// the first session starts and the last session ends.
+	Sessions map[*ConnContext]*Session
+	// Presence and StatusMessage are set by the user
+	// and sent to friends while he is online.
+	Presence      types.Presence
+	StatusMessage string
+	// Invisible user receives friends status changes while his own
+	// online and offline status changes are not sent to friends.
+	Invisible bool
 }
 
 // Hub holds all game state with online users
 // and handles incoming TCP/UDP traffic.
 type Hub struct {
+	opts  hubOptions
 	users map[int]*User
+	// conns maps connections to logged in user IDs so
+	// disconnected users could be found without scanning all users.
+	conns map[*ConnContext]int
+	// timeouts orders sessions by last ping time.
+	timeouts timeoutQueue
+	// lastSeen keeps the time when user was visible online the last
+	// time. It outlives users removal from users map.
+	lastSeen map[int]seen
 
-	login chan *userLogin
-	ping  chan *ping
+	// closing is set on shutdown, new logins are rejected
+	// and friends are no longer notified about status changes.
+	closing bool
+
+	login       chan *userLogin
+	logout      chan *userLogout
+	ping        chan *ping
+	setPresence chan *presenceChange
+	queryLast   chan *lastSeenQuery
+	disconnect  chan *ConnContext
+	shutdown    chan chan struct{}
+	// stopped is closed when Run returns, so late
+	// disconnects don't block transports forever.
+	stopped chan struct{}
 }
 
-func NewHub() *Hub {
+func NewHub(opts ...HubOption) *Hub {
 	return &Hub{
-		users: make(map[int]*User),
-		login: make(chan *userLogin, 10),
-		ping:  make(chan *ping, 10),
+		opts:        newHubOptions(opts),
+		users:       make(map[int]*User),
+		conns:       make(map[*ConnContext]int),
+		lastSeen:    make(map[int]seen),
+		login:       make(chan *userLogin, 10),
+		logout:      make(chan *userLogout),
+		ping:        make(chan *ping, 10),
+		setPresence: make(chan *presenceChange),
+		queryLast:   make(chan *lastSeenQuery),
+		disconnect:  make(chan *ConnContext),
+		shutdown:    make(chan chan struct{}),
+		stopped:     make(chan struct{}),
 	}
 }
 
@@ -59,31 +126,79 @@ func NewHub() *Hub {
 // done channel could be used for both stopping the loop and
 // making unit testing much easier.
 func (h *Hub) Run(checkTick <-chan time.Time, done <-chan struct{}) {
+	defer close(h.stopped)
 	for {
+		if h.handleBuffered() {
+			continue
+		}
 		select {
 		case u := <-h.login:
 			if err := h.handleLogin(u); err != nil {
 				logrus.Errorf("could not handle login: %v", err)
 			}
+		case u := <-h.logout:
+			if err := h.handleLogout(u); err != nil {
+				logrus.Errorf("could not handle logout: %v", err)
+			}
 		case p := <-h.ping:
 			if err := h.handlePing(p); err != nil {
 				logrus.Errorf("could not handle ping: %v", err)
 			}
+		case p := <-h.setPresence:
+			if err := h.handleSetPresence(p); err != nil {
+				logrus.Errorf("could not handle presence change: %v", err)
+			}
+		case q := <-h.queryLast:
+			if err := h.handleLastSeen(q); err != nil {
+				logrus.Errorf("could not handle last seen query: %v", err)
+			}
+		case ctx := <-h.disconnect:
+			h.handleDisconnect(ctx)
 		case <-checkTick:
 			h.checkUsersState()
+		case res := <-h.shutdown:
+			h.handleShutdown()
+			close(res)
 		case <-done:
+			// Messages accepted from transports are not lost.
+			for h.handleBuffered() {
+			}
 			return
 		}
 	}
 }
 
+// handleBuffered handles one buffered login or ping. Logins are
+// handled before pings and both before any other command, so commands
+// which client sent after them are not handled out of order.
+func (h *Hub) handleBuffered() bool {
+	select {
+	case u := <-h.login:
+		if err := h.handleLogin(u); err != nil {
+			logrus.Errorf("could not handle login: %v", err)
+		}
+		return true
+	default:
+	}
+	select {
+	case p := <-h.ping:
+		if err := h.handlePing(p); err != nil {
+			logrus.Errorf("could not handle ping: %v", err)
+		}
+		return true
+	default:
+	}
+	return false
+}
+
 // IncomingMessageHandler handles incoming message.
 func (h *Hub) IncomingMessageHandler(ctx *ConnContext, msg *types.Msg) {
 	switch msg.Cmd {
 	case types.CmdLogin:
 		req := new(types.LoginRequest)
-		if err := json.Unmarshal(msg.Data, req); err != nil {
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
 			logrus.Errorf("could not parse login message: %v", err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
 			return
 		}
 
@@ -93,14 +208,79 @@ func (h *Hub) IncomingMessageHandler(ctx *ConnContext, msg *types.Msg) {
 		}
 	case types.CmdPing:
 		req := new(types.PingRequest)
-		if err := json.Unmarshal(msg.Data, req); err != nil {
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
 			logrus.Errorf("could not parse ping message: %v", err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
 			return
 		}
 
-		h.ping <- &ping{userID: req.UserID, time: time.Now()}
+		h.ping <- &ping{userID: req.UserID, session: req.Session, time: time.Now(), conn: ctx}
+	case types.CmdLogout:
+		req := new(types.LogoutRequest)
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
+			logrus.Errorf("could not parse logout message: %v", err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
+			return
+		}
+
+		h.logout <- &userLogout{userID: req.UserID, conn: ctx}
+	case types.CmdSetPresence:
+		req := new(types.SetPresenceRequest)
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
+			logrus.Errorf("could not parse presence message: %v", err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
+			return
+		}
+		if err := validatePresence(req); err != nil {
+			logrus.Error(err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
+			return
+		}
+
+		h.setPresence <- &presenceChange{req: req, conn: ctx}
+	case types.CmdLastSeen:
+		req := new(types.LastSeenRequest)
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
+			logrus.Errorf("could not parse last seen message: %v", err)
+			ctx.sendError(msg.Cmd, types.ErrCodeBadRequest, err)
+			return
+		}
+
+		h.queryLast <- &lastSeenQuery{req: req, conn: ctx}
 	default:
-		logrus.Errorf("unknown command: %b", msg.Cmd)
+		err := fmt.Errorf("unknown command: %b", msg.Cmd)
+		logrus.Error(err)
+		ctx.sendError(msg.Cmd, types.ErrCodeUnknownCommand, err)
+	}
+}
+
+// DisconnectHandler handles closed connections. It allows to notify
+// friends immediately instead of waiting for ping timeout.
+// Disconnects after Run returned are dropped.
+func (h *Hub) DisconnectHandler(ctx *ConnContext) {
+	select {
+	case h.disconnect <- ctx:
+	case <-h.stopped:
+	}
+}
+
+// Shutdown stops accepting new logins and tells every connected user
+// that server is going away. Hub keeps running after Shutdown so transport
+// servers could be shut down and close connections, done channel passed
+// to Run should be closed afterwards.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	res := make(chan struct{})
+	select {
+	case h.shutdown <- res:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-res:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -110,67 +290,459 @@ func (h *Hub) Users() map[int]*User {
 }
 
 func (h *Hub) handleLogin(login *userLogin) error {
-	logrus.Infof("user=%d friends=%v connected", login.req.UserID, login.req.Friends)
-	u := &User{
-		UserID:       login.req.UserID,
-		Friends:      login.req.Friends,
-		Online:       true,
-		Conn:         login.conn,
-		LastPingTime: time.Now().Add(pingWaitTime),
+	if h.closing {
+		err := errors.New("server is shutting down")
+		login.conn.sendError(types.CmdLogin, types.ErrCodeUnavailable, err)
+		return err
 	}
-	h.users[u.UserID] = u
-	return h.notifyFriends(u, true)
+
+	if h.opts.auth != nil {
+		if err := h.opts.auth.Authenticate(login.req.UserID, login.req.Token); err != nil {
+			err = fmt.Errorf("could not authenticate user %d: %v", login.req.UserID, err)
+			login.conn.sendError(types.CmdLogin, types.ErrCodeUnauthorized, err)
+			return err
+		}
+	}
+
+	friends, err := h.resolveFriends(login.req)
+	if err != nil {
+		err = fmt.Errorf("could not resolve user %d friends: %v", login.req.UserID, err)
+		login.conn.sendError(types.CmdLogin, types.ErrCodeUnavailable, err)
+		return err
+	}
+
+	u, online := h.users[login.req.UserID]
+	if online {
+		if _, ok := u.Sessions[login.conn]; !ok {
+			if err := h.applyLoginPolicy(u, login.conn); err != nil {
+				return err
+			}
+		}
+	}
+
+	logrus.Infof("user=%d friends=%v connected", login.req.UserID, friends)
+	// Connection could be used to log in as another user before.
+	if userID, ok := h.conns[login.conn]; ok && userID != login.req.UserID {
+		if s, ok := h.session(userID, login.conn); ok {
+			h.endSession(s)
+		}
+	}
+
+	s := &Session{Conn: login.conn, LastPingTime: time.Now().Add(pingWaitTime)}
+	if online {
+		// Another session of already online user, friends
+		// already know about him.
+		h.joinSession(u, s, friends)
+	} else {
+		u = &User{
+			UserID:    login.req.UserID,
+			Friends:   friends,
+			Online:    true,
+			Presence:  types.PresenceOnline,
+			Invisible: login.req.Invisible,
+		}
+		if u.Invisible {
+			u.Presence = types.PresenceInvisible
+		}
+		s.User = u
+		u.Sessions = map[*ConnContext]*Session{s.Conn: s}
+		h.addUser(u)
+	}
+
+	if s.Conn.supports(types.FeatureLoginAccepted) {
+		reply := &types.LoginAcceptedReply{UserID: u.UserID, Friends: u.Friends}
+		if err := s.Conn.send(types.CmdLoginAccepted, reply); err != nil {
+			logrus.Errorf("could not confirm user %d login: %v", u.UserID, err)
+		}
+	}
+	if s.Conn.supports(types.FeaturePresenceSnapshot) {
+		if err := h.sendPresenceSnapshot(u, s.Conn); err != nil {
+			logrus.Errorf("could not send presence snapshot to user %d: %v", u.UserID, err)
+		}
+	}
+	if online {
+		return nil
+	}
+	return h.notifyFriends(u)
+}
+
+// applyLoginPolicy handles login of online user from a new
+// connection. It returns error if login is rejected.
+func (h *Hub) applyLoginPolicy(u *User, conn *ConnContext) error {
+	switch h.opts.loginPolicy {
+	case RejectNew:
+		err := fmt.Errorf("user %d is already logged in", u.UserID)
+		conn.sendError(types.CmdLogin, types.ErrCodeConflict, err)
+		return err
+	case KickOld:
+		reply := &types.KickedReply{Reason: "logged in from another connection"}
+		for _, s := range u.Sessions {
+			logrus.Infof("user=%d kicked out", u.UserID)
+			if err := s.Conn.send(types.CmdKicked, reply); err != nil {
+				logrus.Errorf("could not notify user %d about kick: %v", u.UserID, err)
+			}
+			if err := s.Conn.close(); err != nil {
+				logrus.Errorf("could not close client Conn: %v", err)
+			}
+			// User stays online with the new session,
+			// so friends are not notified.
+			h.removeSession(s)
+		}
+	}
+	return nil
+}
+
+// joinSession adds new session to online user. Friends list is
+// replaced by the one from the latest login.
+func (h *Hub) joinSession(u *User, s *Session, friends []int) {
+	if old, ok := u.Sessions[s.Conn]; ok {
+		// Same connection logged in again.
+		h.removeSession(old)
+	}
+	s.User = u
+	h.addSession(s)
+	logrus.Infof("user=%d has %d sessions", u.UserID, len(u.Sessions))
+	u.Friends = friends
+}
+
+// resolveFriends returns sorted friends of the logging in user. With
+// friend graph configured client can only narrow down friends list,
+// users who are not friends in the graph are dropped.
+func (h *Hub) resolveFriends(req *types.LoginRequest) ([]int, error) {
+	if h.opts.graph == nil {
+		return sortFriends(req.Friends), nil
+	}
+
+	friends, err := h.opts.graph.Friends(req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Friends) == 0 {
+		return sortFriends(friends), nil
+	}
+
+	known := make(map[int]bool, len(friends))
+	for _, friendID := range friends {
+		known[friendID] = true
+	}
+	allowed := make([]int, 0, len(req.Friends))
+	for _, friendID := range req.Friends {
+		if !known[friendID] {
+			logrus.Warnf("user=%d is not a friend of user=%d, ignoring", friendID, req.UserID)
+			continue
+		}
+		allowed = append(allowed, friendID)
+	}
+	return sortFriends(allowed), nil
+}
+
+// sortFriends sorts friends list in place and drops duplicates.
+func sortFriends(friends []int) []int {
+	slices.Sort(friends)
+	return slices.Compact(friends)
 }
 
 func (h *Hub) handlePing(p *ping) error {
-	u, ok := h.users[p.userID]
+	s, ok := h.session(p.userID, p.conn)
 	if !ok {
-		return fmt.Errorf("user %d not found", p.userID)
+		err := fmt.Errorf("user %d not found", p.userID)
+		p.conn.sendError(types.CmdPing, types.ErrCodeNotFound, err)
+		return err
+	}
+	if !p.conn.ownsSession(p.session) {
+		err := fmt.Errorf("ping of user %d has wrong session", p.userID)
+		p.conn.sendError(types.CmdPing, types.ErrCodeUnauthorized, err)
+		return err
 	}
-	u.LastPingTime = p.time
+	s.LastPingTime = p.time
+	heap.Fix(&h.timeouts, s.timeoutIndex)
 	return nil
 }
 
-func (h *Hub) checkUsersState() {
-	// 1 Step. Loop through all users and check last ping time.
-	// Mark user as offline if no ping was received after pingWaitTime interval.
-	for _, u := range h.users {
-		if u.Online && u.LastPingTime.Add(pingWaitTime).Before(time.Now()) {
-			logrus.Infof("user=%d disconnected", u.UserID)
-			u.Online = false
-			if err := u.Conn.close(); err != nil {
-				logrus.Errorf("could not close client Conn: %v", err)
+// handleSetPresence stores user's presence and notifies friends. Only
+// user's sessions are allowed to change it.
+func (h *Hub) handleSetPresence(p *presenceChange) error {
+	s, ok := h.session(p.req.UserID, p.conn)
+	if !ok {
+		err := fmt.Errorf("user %d not found", p.req.UserID)
+		p.conn.sendError(types.CmdSetPresence, types.ErrCodeNotFound, err)
+		return err
+	}
+	u := s.User
+
+	before := h.status(u)
+	u.Presence = p.req.Presence
+	u.StatusMessage = p.req.Message
+	u.Invisible = u.Presence == types.PresenceInvisible
+	if u.Invisible && before.Online {
+		h.markSeen(u)
+	}
+	logrus.Infof("user=%d presence=%s message=%q", u.UserID, u.Presence, u.StatusMessage)
+	if h.status(u) == before {
+		// Friends see no difference, e.g. invisible user changed message.
+		return nil
+	}
+	// Becoming invisible or visible again is sent as offline or
+	// online status change, so notifyFriends can't be used here.
+	return h.sendStatus(u)
+}
+
+// handleLastSeen replies with current status of requested friends.
+func (h *Hub) handleLastSeen(q *lastSeenQuery) error {
+	s, ok := h.session(q.req.UserID, q.conn)
+	if !ok {
+		err := fmt.Errorf("user %d not found", q.req.UserID)
+		q.conn.sendError(types.CmdLastSeen, types.ErrCodeNotFound, err)
+		return err
+	}
+	u := s.User
+
+	friends := u.Friends
+	if len(q.req.Friends) > 0 {
+		known := make(map[int]bool, len(u.Friends))
+		for _, friendID := range u.Friends {
+			known[friendID] = true
+		}
+		friends = make([]int, 0, len(q.req.Friends))
+		for _, friendID := range q.req.Friends {
+			if known[friendID] {
+				friends = append(friends, friendID)
 			}
 		}
 	}
 
-	// 2 Step. Loop through all offline users and notify such users
-	// friends about status change.
+	reply := &types.LastSeenReply{Friends: make([]types.StatusChangeReply, 0, len(friends))}
+	for _, friendID := range friends {
+		reply.Friends = append(reply.Friends, h.friendStatus(u, friendID))
+	}
+	return s.Conn.send(types.CmdLastSeenReply, reply)
+}
+
+func validatePresence(req *types.SetPresenceRequest) error {
+	if req.Presence == types.PresenceOffline {
+		return errors.New("offline presence could not be set, logout instead")
+	}
+	// Binary codec decodes any number, unknown presence
+	// could not be encoded in JSON status changes.
+	if req.Presence > types.PresenceInvisible {
+		return fmt.Errorf("unknown presence %d", req.Presence)
+	}
+	if len(req.Message) > types.MaxStatusMessageLength {
+		return fmt.Errorf("status message is longer than %d bytes", types.MaxStatusMessageLength)
+	}
+	return nil
+}
+
+func (h *Hub) handleDisconnect(ctx *ConnContext) {
+	userID, ok := h.conns[ctx]
+	if !ok {
+		return
+	}
+	s, ok := h.session(userID, ctx)
+	if !ok {
+		delete(h.conns, ctx)
+		return
+	}
+
+	logrus.Infof("user=%d connection closed", userID)
+	h.endSession(s)
+}
+
+// handleLogout ends user's session. User is marked offline when his
+// last session ends. Only the session itself is allowed to log out.
+func (h *Hub) handleLogout(logout *userLogout) error {
+	s, ok := h.session(logout.userID, logout.conn)
+	if !ok {
+		err := fmt.Errorf("user %d not found", logout.userID)
+		logout.conn.sendError(types.CmdLogout, types.ErrCodeNotFound, err)
+		return err
+	}
+
+	logrus.Infof("user=%d logged out", logout.userID)
+	h.endSession(s)
+	return nil
+}
+
+// setOffline removes user and notifies his friends immediately.
+func (h *Hub) setOffline(u *User) {
+	u.Online = false
+	if !u.Invisible {
+		h.markSeen(u)
+	}
+	if err := h.notifyFriends(u); err != nil {
+		logrus.Errorf("could not notify User's %d Friends: %v", u.UserID, err)
+	}
+	h.removeUser(u)
+}
+
+// markSeen remembers that user is visible online for the last time.
+func (h *Hub) markSeen(u *User) {
+	h.lastSeen[u.UserID] = seen{time: time.Now(), friends: u.Friends}
+}
+
+func (h *Hub) handleShutdown() {
+	logrus.Infof("shutting down, notifying %d users", len(h.users))
+	h.closing = true
+	reply := &types.GoingAwayReply{Reason: "server is shutting down"}
 	for _, u := range h.users {
-		if u.Online {
-			continue
+		if err := u.send(types.CmdGoingAway, reply); err != nil {
+			logrus.Errorf("could not notify user %d about shutdown: %v", u.UserID, err)
+		}
+	}
+}
+
+// addUser stores online user with his sessions.
+func (h *Hub) addUser(u *User) {
+	h.users[u.UserID] = u
+	for _, s := range u.Sessions {
+		s.User = u
+		h.conns[s.Conn] = u.UserID
+		heap.Push(&h.timeouts, s)
+	}
+}
+
+// delivers reports if status of online user from is sent to online
+// user to. In mutual mode both users must list each other and users
+// never get their own status.
+func (h *Hub) delivers(from, to int) bool {
+	if !h.lists(from, to) {
+		return false
+	}
+	if !h.opts.mutual {
+		return true
+	}
+	return from != to && h.lists(to, from)
+}
+
+// lists reports if online user listerID has userID in his friends
+// list. It takes O(log friends) time as friends are sorted.
+func (h *Hub) lists(listerID, userID int) bool {
+	lister, ok := h.users[listerID]
+	if !ok {
+		return false
+	}
+	_, found := slices.BinarySearch(lister.Friends, userID)
+	return found
+}
+
+// removeUser forgets user with all his sessions.
+func (h *Hub) removeUser(u *User) {
+	for _, s := range u.Sessions {
+		h.removeSession(s)
+	}
+	delete(h.users, u.UserID)
+}
+
+// checkUsersState ends sessions if no ping was received after
+// pingWaitTime interval. Only expired sessions are visited.
+func (h *Hub) checkUsersState() {
+	now := time.Now()
+	for {
+		s, ok := h.timeouts.expired(now)
+		if !ok {
+			return
 		}
-		if err := h.notifyFriends(u, false); err != nil {
-			logrus.Errorf("could not notify User's %d Friends: %v", u.UserID, err)
+
+		logrus.Infof("user=%d disconnected", s.User.UserID)
+		if err := s.Conn.close(); err != nil {
+			logrus.Errorf("could not close client Conn: %v", err)
 		}
+		h.endSession(s)
+	}
+}
 
-		delete(h.users, u.UserID)
+// status returns user's status as seen by his friends.
+// Invisible users look offline.
+func (h *Hub) status(u *User) types.StatusChangeReply {
+	if !u.Online || u.Invisible {
+		return h.offlineStatus(u.UserID)
+	}
+	return types.StatusChangeReply{
+		UserID:   u.UserID,
+		Online:   true,
+		Presence: u.Presence,
+		Message:  u.StatusMessage,
 	}
 }
 
+// offlineStatus returns offline user status with last seen time if known.
+func (h *Hub) offlineStatus(userID int) types.StatusChangeReply {
+	status := types.StatusChangeReply{UserID: userID}
+	if seen, ok := h.lastSeen[userID]; ok {
+		status.LastSeen = seen.time.Unix()
+	}
+	return status
+}
+
+// friendStatus returns status of the friend as seen by the given user.
+// Friends whose status changes are not sent to the user look offline,
+// otherwise user would see them online forever. Their last seen time
+// is hidden too, anyone could list anyone without friend graph.
+func (h *Hub) friendStatus(u *User, friendID int) types.StatusChangeReply {
+	if f, ok := h.users[friendID]; ok {
+		if h.delivers(friendID, u.UserID) {
+			return h.status(f)
+		}
+		return types.StatusChangeReply{UserID: friendID}
+	}
+	if h.seenBy(friendID, u.UserID) {
+		return h.offlineStatus(friendID)
+	}
+	return types.StatusChangeReply{UserID: friendID}
+}
+
+// seenBy reports if status of offline user from was delivered to
+// online user to when from was online the last time.
+func (h *Hub) seenBy(from, to int) bool {
+	seen, ok := h.lastSeen[from]
+	if !ok {
+		return false
+	}
+	if _, found := slices.BinarySearch(seen.friends, to); !found {
+		return false
+	}
+	return !h.opts.mutual || from != to && h.lists(to, from)
+}
+
+// sendPresenceSnapshot sends current status of all user's friends
+// so client knows who is online without waiting for status changes.
+func (h *Hub) sendPresenceSnapshot(u *User, conn *ConnContext) error {
+	snapshot := &types.PresenceSnapshotReply{
+		Friends: make([]types.StatusChangeReply, 0, len(u.Friends)),
+	}
+	for _, friendID := range u.Friends {
+		snapshot.Friends = append(snapshot.Friends, h.friendStatus(u, friendID))
+	}
+
+	return conn.send(types.CmdPresenceSnapshot, snapshot)
+}
+
 // notifyFriends notifies all user's online friends about his
-// status change.
-func (h *Hub) notifyFriends(u *User, online bool) error {
-	status := &types.StatusChangeReply{UserID: u.UserID, Online: online}
-	msg, err := types.EncodeMsg(types.CmdStatusChange, status)
-	if err != nil {
-		return err
+// current status. Nothing is sent for invisible users.
+func (h *Hub) notifyFriends(u *User) error {
+	if u.Invisible {
+		return nil
+	}
+	return h.sendStatus(u)
+}
+
+// sendStatus sends user's current status to all his online watchers.
+// Watchers are online friends which status is delivered to, so it
+// takes O(friends * log friends) time regardless of online users.
+func (h *Hub) sendStatus(u *User) error {
+	// All users are leaving together on shutdown.
+	if h.closing {
+		return nil
 	}
 
+	status := h.status(u)
+
 	var writeErr error
 	for _, friendID := range u.Friends {
-		if f, ok := h.users[friendID]; ok && f.Online {
-			writeErr = f.Conn.write(msg)
+		if f, ok := h.users[friendID]; ok && f.Online && h.delivers(u.UserID, friendID) {
+			if err := f.send(types.CmdStatusChange, &status); err != nil {
+				writeErr = err
+			}
 		}
 	}
 	return writeErr
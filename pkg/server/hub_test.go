@@ -1,8 +1,12 @@
 package server
 
 import (
+	"container/heap"
+	"context"
+	"encoding/json"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -32,33 +36,894 @@ func TestHubAcceptLogin(t *testing.T) {
 	if !usr.Online {
 		t.Error("expected user to be online")
 	}
-	if usr.Conn.tcpConn != connCtx.tcpConn {
-		t.Errorf("expected user to get tcp conn")
+	if _, ok := usr.Sessions[connCtx]; !ok || len(usr.Sessions) != 1 {
+		t.Errorf("expected user to get session with tcp conn")
 	}
 	if !reflect.DeepEqual(usr.Friends, login.Friends) {
 		t.Errorf("expected friends %v, got %v", login.Friends, usr.Friends)
 	}
 }
 
+func TestHubSendPresenceSnapshotOnLogin(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	h.addUser(createOnlineUser(2, []int{1}))
+	login := &types.LoginRequest{UserID: 1, Friends: []int{2, 3}}
+	b, _ := types.EncodeMsg(types.CmdLogin, login)
+	connCtx := createConnContext()
+
+	h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+	done <- struct{}{}
+
+	msgs := writtenMsgs(connCtx)
+	if len(msgs) != 2 || msgs[0].Cmd != types.CmdLoginAccepted || msgs[1].Cmd != types.CmdPresenceSnapshot {
+		t.Fatalf("expected login accepted and presence snapshot replies, got %v", msgs)
+	}
+	snapshot := new(types.PresenceSnapshotReply)
+	if err := json.Unmarshal(msgs[1].Data, snapshot); err != nil {
+		t.Fatalf("could not parse snapshot: %v", err)
+	}
+	expected := []types.StatusChangeReply{
+		{UserID: 2, Online: true, Presence: types.PresenceOnline},
+		{UserID: 3, Online: false},
+	}
+	if !reflect.DeepEqual(snapshot.Friends, expected) {
+		t.Errorf("expected snapshot %v, got %v", expected, snapshot.Friends)
+	}
+}
+
+func TestHubRepeatedLogin(t *testing.T) {
+	for _, policy := range []LoginPolicy{AllowMultiple, RejectNew, KickOld} {
+		t.Run(policy.String(), func(tt *testing.T) {
+			h := NewHub(WithLoginPolicy(policy))
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			friend := createOnlineUser(2, []int{1})
+			h.addUser(friend)
+			login, _ := types.EncodeMsg(types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+			connCtx := createConnContext()
+
+			// Client resends login if confirmation is lost.
+			h.IncomingMessageHandler(connCtx, types.DecodeMsg(login))
+			h.IncomingMessageHandler(connCtx, types.DecodeMsg(login))
+			done <- struct{}{}
+
+			if u, ok := h.users[1]; !ok || len(u.Sessions) != 1 {
+				tt.Fatalf("expected user 1 with one session, got %v", h.users[1])
+			}
+			var accepted int
+			for _, msg := range writtenMsgs(connCtx) {
+				if msg.Cmd == types.CmdLoginAccepted {
+					accepted++
+				}
+			}
+			if accepted != 2 {
+				tt.Errorf("expected both logins to be accepted, got %d", accepted)
+			}
+			if msgs := writtenMsgs(userConn(friend)); len(msgs) != 1 {
+				tt.Errorf("expected friend to be notified once, got %v", msgs)
+			}
+		})
+	}
+}
+
+func TestHubResolveFriendsFromGraph(t *testing.T) {
+	graph := NewMemoryGraph(map[int][]int{1: {2, 3}})
+	tests := []struct {
+		name     string
+		friends  []int
+		expected []int
+	}{
+		{name: "empty client list", friends: nil, expected: []int{2, 3}},
+		{name: "client list narrows down friends", friends: []int{3}, expected: []int{3}},
+		{name: "unknown friends are dropped", friends: []int{2, 4}, expected: []int{2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			h := NewHub(WithFriendGraph(graph))
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			h.addUser(createOnlineUser(4, []int{1}))
+			login := &types.LoginRequest{UserID: 1, Friends: test.friends}
+			b, _ := types.EncodeMsg(types.CmdLogin, login)
+
+			h.IncomingMessageHandler(createConnContext(), types.DecodeMsg(b))
+			done <- struct{}{}
+
+			if friends := h.users[1].Friends; !reflect.DeepEqual(friends, test.expected) {
+				tt.Errorf("expected friends %v, got %v", test.expected, friends)
+			}
+			if msgs := writtenMsgs(userConn(h.users[4])); len(msgs) != 0 {
+				tt.Errorf("expected user who is not a friend not to be notified, got %v", msgs)
+			}
+		})
+	}
+}
+
+func TestHubAuthenticateLogin(t *testing.T) {
+	auth := NewHMACAuthenticator([]byte("secret"))
+	h := NewHub(WithAuthenticator(auth))
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	valid := createConnContext()
+	forged := createConnContext()
+	login := func(ctx *ConnContext, req *types.LoginRequest) {
+		b, _ := types.EncodeMsg(types.CmdLogin, req)
+		h.IncomingMessageHandler(ctx, types.DecodeMsg(b))
+	}
+
+	login(valid, &types.LoginRequest{UserID: 1, Token: auth.Token(1, time.Now().Add(time.Minute))})
+	// Token of user 1 could not be used to log in as user 2.
+	login(forged, &types.LoginRequest{UserID: 2, Token: auth.Token(1, time.Now().Add(time.Minute))})
+	login(forged, &types.LoginRequest{UserID: 3})
+	done <- struct{}{}
+
+	if _, ok := h.users[1]; !ok {
+		t.Error("expected user with valid token to log in")
+	}
+	if len(h.users) != 1 {
+		t.Errorf("expected only user 1 to log in, got %v", h.users)
+	}
+	msgs := writtenMsgs(forged)
+	if len(msgs) != 2 {
+		t.Fatalf("expected error replies for both logins, got %v", msgs)
+	}
+	for _, msg := range msgs {
+		reply := new(types.ErrorReply)
+		if err := json.Unmarshal(msg.Data, reply); err != nil || msg.Cmd != types.CmdError {
+			t.Fatalf("expected error reply, got %v", msg)
+		}
+		if reply.Code != types.ErrCodeUnauthorized || reply.Cmd != types.CmdLogin {
+			t.Errorf("expected unauthorized login error, got %+v", reply)
+		}
+	}
+}
+
+func TestHubFriendshipModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []HubOption
+		friends1 []int
+		friends2 []int
+		// notified is true if user 2 gets user 1 status.
+		notified bool
+		// sees is true if user 1 sees user 2 online in snapshot.
+		sees bool
+		// self is true if user 1 gets his own status.
+		self bool
+	}{
+		{name: "one-sided", friends1: []int{2}, notified: true},
+		{name: "other side", friends2: []int{1}},
+		{name: "both sides", friends1: []int{2}, friends2: []int{1}, notified: true, sees: true},
+		{name: "self", friends1: []int{1}, self: true},
+		{name: "mutual one-sided", opts: []HubOption{WithMutualFriendship()}, friends1: []int{2}},
+		{name: "mutual other side", opts: []HubOption{WithMutualFriendship()}, friends2: []int{1}},
+		{name: "mutual", opts: []HubOption{WithMutualFriendship()}, friends1: []int{2}, friends2: []int{1}, notified: true, sees: true},
+		{name: "mutual self", opts: []HubOption{WithMutualFriendship()}, friends1: []int{1, 2}, friends2: []int{1}, notified: true, sees: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			h := NewHub(test.opts...)
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			user2 := createOnlineUser(2, test.friends2)
+			h.addUser(user2)
+			login := &types.LoginRequest{UserID: 1, Friends: test.friends1}
+			b, _ := types.EncodeMsg(types.CmdLogin, login)
+			connCtx := createConnContext()
+
+			h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+			done <- struct{}{}
+
+			if msgs := writtenMsgs(userConn(user2)); (len(msgs) == 1) != test.notified {
+				tt.Errorf("expected user 2 notified=%v, got %v", test.notified, msgs)
+			}
+
+			var sees, self bool
+			for _, msg := range writtenMsgs(connCtx) {
+				switch msg.Cmd {
+				case types.CmdPresenceSnapshot:
+					snapshot := new(types.PresenceSnapshotReply)
+					if err := json.Unmarshal(msg.Data, snapshot); err != nil {
+						tt.Fatalf("could not parse snapshot: %v", err)
+					}
+					for _, f := range snapshot.Friends {
+						sees = sees || (f.UserID == 2 && f.Online)
+					}
+				case types.CmdStatusChange:
+					self = true
+				}
+			}
+			if sees != test.sees {
+				tt.Errorf("expected user 1 sees user 2 online=%v", test.sees)
+			}
+			if self != test.self {
+				tt.Errorf("expected user 1 gets own status=%v", test.self)
+			}
+		})
+	}
+}
+
 func TestHubAcceptPing(t *testing.T) {
 	h := NewHub()
 	mockTicker := make(chan time.Time)
 	done := make(chan struct{})
 	go h.Run(mockTicker, done)
 	user := createOnlineUser(1, []int{})
-	h.users[user.UserID] = user
+	h.addUser(user)
 
 	ping := &types.PingRequest{UserID: user.UserID}
 	b, _ := types.EncodeMsg(types.CmdPing, ping)
 	msg := types.DecodeMsg(b)
-	connCtx := createConnContext()
+	otherConn := createConnContext()
 
-	h.IncomingMessageHandler(connCtx, msg)
+	h.IncomingMessageHandler(userConn(user), msg)
+	h.IncomingMessageHandler(otherConn, msg)
 	done <- struct{}{}
 
-	if user.LastPingTime.IsZero() {
+	if userSession(user).LastPingTime.IsZero() {
 		t.Error("expected to set last ping time")
 	}
+	if msgs := writtenMsgs(otherConn); len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+		t.Errorf("expected error reply for ping from another connection, got %v", msgs)
+	}
+}
+
+func TestHubPingRequiresSession(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	user := createOnlineUser(1, []int{})
+	connCtx := userConn(user)
+	connCtx.welcome = &types.HelloReply{Accepted: true, Session: "token"}
+	h.addUser(user)
+	ping := func(session string) {
+		b, _ := types.EncodeMsg(types.CmdPing, &types.PingRequest{UserID: 1, Session: session})
+		h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+	}
+
+	ping("")
+	ping("guess")
+	failed := userSession(user).LastPingTime
+	ping("token")
+	done <- struct{}{}
+
+	if !failed.IsZero() {
+		t.Error("expected pings with wrong session not to update last ping time")
+	}
+	if userSession(user).LastPingTime.IsZero() {
+		t.Error("expected ping with issued session to update last ping time")
+	}
+	msgs := writtenMsgs(connCtx)
+	if len(msgs) != 2 {
+		t.Fatalf("expected error replies for pings with wrong session, got %v", msgs)
+	}
+	for _, msg := range msgs {
+		reply := new(types.ErrorReply)
+		if err := json.Unmarshal(msg.Data, reply); err != nil || reply.Code != types.ErrCodeUnauthorized {
+			t.Errorf("expected unauthorized error, got %v", msg)
+		}
+	}
+}
+
+func TestHubSetPresence(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *types.SetPresenceRequest
+		foreign  bool
+		expected *types.StatusChangeReply
+		// lastSeen is true if status should have last seen time.
+		lastSeen bool
+		errCode  types.ErrorCode
+	}{
+		{
+			name:     "away with message",
+			req:      &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceAway, Message: "lunch"},
+			expected: &types.StatusChangeReply{UserID: 1, Online: true, Presence: types.PresenceAway, Message: "lunch"},
+		},
+		{
+			name:     "invisible looks offline",
+			req:      &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceInvisible, Message: "hidden"},
+			expected: &types.StatusChangeReply{UserID: 1},
+			lastSeen: true,
+		},
+		{
+			name: "same status is not sent again",
+			req:  &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceOnline},
+		},
+		{
+			name:    "offline presence",
+			req:     &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceOffline},
+			errCode: types.ErrCodeBadRequest,
+		},
+		{
+			name:    "too long message",
+			req:     &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceBusy, Message: strings.Repeat("x", types.MaxStatusMessageLength+1)},
+			errCode: types.ErrCodeBadRequest,
+		},
+		{
+			name:    "other connection",
+			req:     &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceBusy},
+			foreign: true,
+			errCode: types.ErrCodeNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			h := NewHub()
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			user1 := createOnlineUser(1, []int{2})
+			friend := createOnlineUser(2, []int{1})
+			h.addUser(user1)
+			h.addUser(friend)
+			connCtx := userConn(user1)
+			if test.foreign {
+				connCtx = createConnContext()
+			}
+			b, _ := types.EncodeMsg(types.CmdSetPresence, test.req)
+
+			h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+			done <- struct{}{}
+
+			if test.errCode != 0 {
+				msgs := writtenMsgs(connCtx)
+				if len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+					tt.Fatalf("expected error reply, got %v", msgs)
+				}
+				reply := new(types.ErrorReply)
+				if err := json.Unmarshal(msgs[0].Data, reply); err != nil || reply.Code != test.errCode {
+					tt.Fatalf("expected error code %d, got %+v %v", test.errCode, reply, err)
+				}
+				return
+			}
+
+			msgs := writtenMsgs(userConn(friend))
+			if test.expected == nil {
+				if len(msgs) != 0 {
+					tt.Fatalf("expected no status changes, got %v", msgs)
+				}
+				return
+			}
+			if len(msgs) != 1 || msgs[0].Cmd != types.CmdStatusChange {
+				tt.Fatalf("expected status change, got %v", msgs)
+			}
+			status := new(types.StatusChangeReply)
+			if err := json.Unmarshal(msgs[0].Data, status); err != nil {
+				tt.Fatalf("could not parse status change: %v", err)
+			}
+			if (status.LastSeen != 0) != test.lastSeen {
+				tt.Errorf("expected last seen time set=%v, got %+v", test.lastSeen, status)
+			}
+			status.LastSeen = 0
+			if *status != *test.expected {
+				tt.Errorf("expected status %+v, got %+v", test.expected, status)
+			}
+		})
+	}
+}
+
+func TestHubRejectUnknownPresence(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	user1 := createOnlineUser(1, []int{2})
+	friend := createOnlineUser(2, []int{1})
+	h.addUser(user1)
+	h.addUser(friend)
+	connCtx := userConn(user1)
+	connCtx.framed = true
+	connCtx.welcomed = true
+	connCtx.codec = types.Binary
+	// Binary codec lets client send presence JSON could not encode.
+	b, _ := types.EncodeFrame(types.Binary, types.CmdSetPresence, &types.SetPresenceRequest{UserID: 1, Presence: 200})
+	msg, _ := types.DecodeFrame(b)
+
+	h.IncomingMessageHandler(connCtx, msg)
+	done <- struct{}{}
+
+	msgs := writtenMsgs(connCtx)
+	if len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+		t.Fatalf("expected error reply, got %v", msgs)
+	}
+	reply := new(types.ErrorReply)
+	if err := connCtx.unmarshal(msgs[0].Data, reply); err != nil || reply.Code != types.ErrCodeBadRequest {
+		t.Fatalf("expected bad request error, got %+v %v", reply, err)
+	}
+	if p := h.users[1].Presence; p != types.PresenceOnline {
+		t.Errorf("expected presence to stay online, got %v", p)
+	}
+	if msgs := writtenMsgs(userConn(friend)); len(msgs) != 0 {
+		t.Errorf("expected friend not to be notified, got %v", msgs)
+	}
+}
+
+func TestHubInvisibleUser(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	friend := createOnlineUser(2, []int{1})
+	h.addUser(friend)
+	connCtx := createConnContext()
+	send := func(ctx *ConnContext, cmd types.CommandType, v interface{}) {
+		b, _ := types.EncodeMsg(cmd, v)
+		h.IncomingMessageHandler(ctx, types.DecodeMsg(b))
+	}
+
+	send(connCtx, types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}, Invisible: true})
+	send(userConn(friend), types.CmdSetPresence, &types.SetPresenceRequest{UserID: 2, Presence: types.PresenceAway})
+	// Changing message while invisible is not visible to friends.
+	send(connCtx, types.CmdSetPresence, &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceInvisible, Message: "hidden"})
+	send(connCtx, types.CmdSetPresence, &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceOnline})
+	send(connCtx, types.CmdSetPresence, &types.SetPresenceRequest{UserID: 1, Presence: types.PresenceInvisible})
+	send(connCtx, types.CmdLogout, &types.LogoutRequest{UserID: 1})
+	done <- struct{}{}
+
+	var statuses []types.StatusChangeReply
+	for _, msg := range writtenMsgs(userConn(friend)) {
+		status := types.StatusChangeReply{}
+		if err := json.Unmarshal(msg.Data, &status); err != nil {
+			t.Fatalf("could not parse status change: %v", err)
+		}
+		if status.LastSeen != 0 {
+			status.LastSeen = 1
+		}
+		statuses = append(statuses, status)
+	}
+	// Last seen time is recorded when user becomes invisible.
+	expected := []types.StatusChangeReply{
+		{UserID: 1, Online: true, Presence: types.PresenceOnline},
+		{UserID: 1, LastSeen: 1},
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("expected friend to see only visible period %v, got %v", expected, statuses)
+	}
+
+	msgs := writtenMsgs(connCtx)[1:]
+	if len(msgs) != 2 || msgs[0].Cmd != types.CmdPresenceSnapshot || msgs[1].Cmd != types.CmdStatusChange {
+		t.Fatalf("expected invisible user to get snapshot and friend status change, got %v", msgs)
+	}
+	snapshot := new(types.PresenceSnapshotReply)
+	if err := json.Unmarshal(msgs[0].Data, snapshot); err != nil {
+		t.Fatalf("could not parse snapshot: %v", err)
+	}
+	if len(snapshot.Friends) != 1 || !snapshot.Friends[0].Online {
+		t.Errorf("expected invisible user to see friend online, got %v", snapshot.Friends)
+	}
+}
+
+func TestHubLastSeen(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	user := createOnlineUser(1, []int{2, 3, 4, 6, 7})
+	h.addUser(user)
+	h.addUser(createOnlineUser(2, []int{1}))
+	h.addUser(createOnlineUser(5, []int{1}))
+	seenTime := time.Now().Add(-5 * time.Minute)
+	h.lastSeen[3] = seen{time: seenTime, friends: []int{1}}
+	// User 6 did not list user 1 and user 7 does not list him now.
+	h.lastSeen[6] = seen{time: seenTime, friends: []int{2}}
+	h.lastSeen[7] = seen{time: seenTime, friends: []int{1}}
+	h.addUser(createOnlineUser(7, nil))
+	send := func(ctx *ConnContext, cmd types.CommandType, v interface{}) {
+		b, _ := types.EncodeMsg(cmd, v)
+		h.IncomingMessageHandler(ctx, types.DecodeMsg(b))
+	}
+
+	// User 5 is not a friend, so it is left out.
+	send(userConn(user), types.CmdLastSeen, &types.LastSeenRequest{UserID: 1, Friends: []int{2, 3, 4, 5, 6, 7}})
+	send(userConn(user), types.CmdLastSeen, &types.LastSeenRequest{UserID: 1})
+	// Removed users are remembered.
+	send(userConn(h.users[2]), types.CmdLogout, &types.LogoutRequest{UserID: 2})
+	send(userConn(user), types.CmdLastSeen, &types.LastSeenRequest{UserID: 1, Friends: []int{2}})
+	foreignCtx := createConnContext()
+	send(foreignCtx, types.CmdLastSeen, &types.LastSeenRequest{UserID: 1})
+	done <- struct{}{}
+
+	var replies []*types.LastSeenReply
+	for _, msg := range writtenMsgs(userConn(user)) {
+		if msg.Cmd != types.CmdLastSeenReply {
+			continue
+		}
+		reply := new(types.LastSeenReply)
+		if err := json.Unmarshal(msg.Data, reply); err != nil {
+			t.Fatalf("could not parse last seen reply: %v", err)
+		}
+		replies = append(replies, reply)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("expected 3 last seen replies, got %d", len(replies))
+	}
+
+	expected := []types.StatusChangeReply{
+		{UserID: 2, Online: true, Presence: types.PresenceOnline},
+		{UserID: 3, LastSeen: seenTime.Unix()},
+		{UserID: 4},
+		{UserID: 6},
+		{UserID: 7},
+	}
+	for i, reply := range replies[:2] {
+		if !reflect.DeepEqual(reply.Friends, expected) {
+			t.Errorf("expected reply %d to be %v, got %v", i, expected, reply.Friends)
+		}
+	}
+	if f := replies[2].Friends; len(f) != 1 || f[0].Online || f[0].LastSeen == 0 {
+		t.Errorf("expected user 2 last seen time after logout, got %v", f)
+	}
+	if msgs := writtenMsgs(foreignCtx); len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+		t.Errorf("expected error reply for other connection, got %v", msgs)
+	}
+}
+
+func TestHubReplyErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		msg          *types.Msg
+		expectedCode types.ErrorCode
+	}{
+		{
+			name:         "invalid login payload",
+			msg:          &types.Msg{Cmd: types.CmdLogin, Data: []byte("{")},
+			expectedCode: types.ErrCodeBadRequest,
+		},
+		{
+			name:         "invalid ping payload",
+			msg:          &types.Msg{Cmd: types.CmdPing, Data: []byte("[]")},
+			expectedCode: types.ErrCodeBadRequest,
+		},
+		{
+			name:         "ping for unknown user",
+			msg:          &types.Msg{Cmd: types.CmdPing, Data: []byte("{\"user_id\":5}")},
+			expectedCode: types.ErrCodeNotFound,
+		},
+		{
+			name:         "unknown command",
+			msg:          &types.Msg{Cmd: types.CommandType(0x7f)},
+			expectedCode: types.ErrCodeUnknownCommand,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			h := NewHub()
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			connCtx := createConnContext()
+
+			h.IncomingMessageHandler(connCtx, test.msg)
+			done <- struct{}{}
+
+			msgs := writtenMsgs(connCtx)
+			if len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+				tt.Fatalf("expected error reply, got %v", msgs)
+			}
+			reply := new(types.ErrorReply)
+			if err := json.Unmarshal(msgs[0].Data, reply); err != nil {
+				tt.Fatalf("could not parse error reply: %v", err)
+			}
+			if reply.Code != test.expectedCode || reply.Cmd != test.msg.Cmd {
+				tt.Errorf("expected error code %d for command %d, got %+v", test.expectedCode, test.msg.Cmd, reply)
+			}
+		})
+	}
+}
+
+func TestHubDisconnectNotifiesFriends(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	friend := createOnlineUser(2, []int{1})
+	h.addUser(friend)
+	login := &types.LoginRequest{UserID: 1, Friends: []int{2}}
+	b, _ := types.EncodeMsg(types.CmdLogin, login)
+	connCtx := createConnContext()
+
+	h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+	h.DisconnectHandler(connCtx)
+	// Unknown connections are ignored.
+	h.DisconnectHandler(createConnContext())
+	done <- struct{}{}
+
+	if _, ok := h.users[1]; ok {
+		t.Fatal("expected disconnected user to be removed")
+	}
+	if _, ok := h.conns[connCtx]; ok {
+		t.Fatalf("expected connection to be forgotten, got %v", h.conns)
+	}
+
+	msgs := writtenMsgs(userConn(friend))
+	if len(msgs) != 2 {
+		t.Fatalf("expected online and offline status changes, got %v", msgs)
+	}
+	status := new(types.StatusChangeReply)
+	if err := json.Unmarshal(msgs[1].Data, status); err != nil {
+		t.Fatalf("could not parse status change: %v", err)
+	}
+	if status.UserID != 1 || status.Online || status.LastSeen == 0 {
+		t.Errorf("expected user 1 offline status with last seen time, got %+v", status)
+	}
+}
+
+func TestHubDisconnectAfterStop(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	done <- struct{}{}
+
+	returned := make(chan struct{})
+	go func() {
+		h.DisconnectHandler(createConnContext())
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("expected disconnect after hub stopped not to block")
+	}
+}
+
+func TestHubLogout(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	friend := createOnlineUser(2, []int{1})
+	h.addUser(friend)
+	login := &types.LoginRequest{UserID: 1, Friends: []int{2}}
+	b, _ := types.EncodeMsg(types.CmdLogin, login)
+	connCtx := createConnContext()
+	otherCtx := createConnContext()
+	logout, _ := types.EncodeMsg(types.CmdLogout, &types.LogoutRequest{UserID: 1})
+
+	h.IncomingMessageHandler(connCtx, types.DecodeMsg(b))
+	// Other connection is not allowed to log user out.
+	h.IncomingMessageHandler(otherCtx, types.DecodeMsg(logout))
+	h.IncomingMessageHandler(connCtx, types.DecodeMsg(logout))
+	done <- struct{}{}
+
+	if _, ok := h.users[1]; ok {
+		t.Fatal("expected logged out user to be removed")
+	}
+	if msgs := writtenMsgs(otherCtx); len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+		t.Errorf("expected error reply for foreign logout, got %v", msgs)
+	}
+
+	msgs := writtenMsgs(userConn(friend))
+	if len(msgs) != 2 {
+		t.Fatalf("expected online and offline status changes, got %v", msgs)
+	}
+	status := new(types.StatusChangeReply)
+	if err := json.Unmarshal(msgs[1].Data, status); err != nil {
+		t.Fatalf("could not parse status change: %v", err)
+	}
+	if status.UserID != 1 || status.Online || status.LastSeen == 0 {
+		t.Errorf("expected user 1 offline status with last seen time, got %+v", status)
+	}
+}
+
+func TestHubMultipleSessions(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	friend := createOnlineUser(2, []int{1})
+	h.addUser(friend)
+	phone := createConnContext()
+	laptop := createConnContext()
+	send := func(ctx *ConnContext, cmd types.CommandType, v interface{}) {
+		b, _ := types.EncodeMsg(cmd, v)
+		h.IncomingMessageHandler(ctx, types.DecodeMsg(b))
+	}
+
+	send(phone, types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+	send(laptop, types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+	send(userConn(friend), types.CmdSetPresence, &types.SetPresenceRequest{UserID: 2, Presence: types.PresenceAway})
+	send(phone, types.CmdLogout, &types.LogoutRequest{UserID: 1})
+	send(laptop, types.CmdPing, &types.PingRequest{UserID: 1})
+	// Logged out session can't be used anymore.
+	send(phone, types.CmdPing, &types.PingRequest{UserID: 1})
+	h.DisconnectHandler(laptop)
+	done <- struct{}{}
+
+	if _, ok := h.users[1]; ok {
+		t.Fatal("expected user to be removed after last session ends")
+	}
+	if len(h.timeouts) != 1 {
+		t.Errorf("expected only friend session in timeouts queue, got %v", h.timeouts)
+	}
+
+	var statuses []bool
+	for _, msg := range writtenMsgs(userConn(friend)) {
+		status := new(types.StatusChangeReply)
+		if err := json.Unmarshal(msg.Data, status); err != nil {
+			t.Fatalf("could not parse status change: %v", err)
+		}
+		statuses = append(statuses, status.Online)
+	}
+	if !reflect.DeepEqual(statuses, []bool{true, false}) {
+		t.Errorf("expected friend to be notified once per online change, got %v", statuses)
+	}
+
+	for _, ctx := range []*ConnContext{phone, laptop} {
+		var away bool
+		for _, msg := range writtenMsgs(ctx) {
+			status := new(types.StatusChangeReply)
+			if msg.Cmd == types.CmdStatusChange && json.Unmarshal(msg.Data, status) == nil {
+				away = away || status.Presence == types.PresenceAway
+			}
+		}
+		if !away {
+			t.Errorf("expected each session to get friend status changes")
+		}
+	}
+	for _, msg := range writtenMsgs(laptop) {
+		if msg.Cmd == types.CmdError {
+			t.Errorf("expected user to stay online after another session logs out, got %v", msg)
+		}
+	}
+	if msgs := writtenMsgs(phone); msgs[len(msgs)-1].Cmd != types.CmdError {
+		t.Errorf("expected error reply for ping from logged out session, got %v", msgs)
+	}
+}
+
+func TestHubSessionsExpireSeparately(t *testing.T) {
+	h := NewHub()
+	friend := createOnlineUser(2, []int{1})
+	userSession(friend).LastPingTime = time.Now().Add(time.Minute)
+	h.addUser(friend)
+	user := createOnlineUser(1, []int{2})
+	stale := userConn(user)
+	active := &Session{Conn: createConnContext(), LastPingTime: time.Now().Add(time.Minute)}
+	user.Sessions[active.Conn] = active
+	h.addUser(user)
+
+	h.checkUsersState()
+
+	if _, ok := h.users[1]; !ok {
+		t.Fatal("expected user to stay online with active session")
+	}
+	if _, ok := user.Sessions[stale]; ok || len(user.Sessions) != 1 {
+		t.Errorf("expected only active session left, got %v", user.Sessions)
+	}
+	if _, ok := h.conns[stale]; ok {
+		t.Error("expected stale connection to be forgotten")
+	}
+	if msgs := writtenMsgs(userConn(friend)); len(msgs) != 0 {
+		t.Errorf("expected friend not to be notified, got %v", msgs)
+	}
+}
+
+func TestHubLoginPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy LoginPolicy
+		// sessions are expected connections of user 1, 0 is the
+		// first connection and 1 is the second one.
+		sessions []int
+		// reply is a command expected as the last message for
+		// the first and the second connection.
+		reply [2]types.CommandType
+	}{
+		{
+			name:     "allow multiple",
+			policy:   AllowMultiple,
+			sessions: []int{0, 1},
+			reply:    [2]types.CommandType{types.CmdStatusChange, types.CmdStatusChange},
+		},
+		{
+			name:     "reject new",
+			policy:   RejectNew,
+			sessions: []int{0},
+			reply:    [2]types.CommandType{types.CmdStatusChange, types.CmdError},
+		},
+		{
+			name:     "kick old",
+			policy:   KickOld,
+			sessions: []int{1},
+			reply:    [2]types.CommandType{types.CmdKicked, types.CmdStatusChange},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			h := NewHub(WithLoginPolicy(test.policy))
+			mockTicker := make(chan time.Time)
+			done := make(chan struct{})
+			go h.Run(mockTicker, done)
+			friend := createOnlineUser(2, []int{1})
+			h.addUser(friend)
+			conns := []*ConnContext{createConnContext(), createConnContext()}
+			send := func(ctx *ConnContext, cmd types.CommandType, v interface{}) {
+				b, _ := types.EncodeMsg(cmd, v)
+				h.IncomingMessageHandler(ctx, types.DecodeMsg(b))
+			}
+
+			send(conns[0], types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+			send(conns[1], types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+			// Same connection could always log in again.
+			send(conns[test.sessions[0]], types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{2}})
+			send(userConn(friend), types.CmdSetPresence, &types.SetPresenceRequest{UserID: 2, Presence: types.PresenceAway})
+			done <- struct{}{}
+
+			u, ok := h.users[1]
+			if !ok {
+				tt.Fatal("expected user to stay online")
+			}
+			if len(u.Sessions) != len(test.sessions) {
+				tt.Errorf("expected %d sessions, got %v", len(test.sessions), u.Sessions)
+			}
+			for _, i := range test.sessions {
+				if _, ok := u.Sessions[conns[i]]; !ok {
+					tt.Errorf("expected connection %d to have a session", i)
+				}
+			}
+			for i, conn := range conns {
+				msgs := writtenMsgs(conn)
+				if len(msgs) == 0 || msgs[len(msgs)-1].Cmd != test.reply[i] {
+					tt.Errorf("expected connection %d last reply %d, got %v", i, test.reply[i], msgs)
+				}
+				if kicked := test.reply[i] == types.CmdKicked; conn.tcpConn.(*mockTCPConn).closed != kicked {
+					tt.Errorf("expected connection %d closed=%v", i, kicked)
+				}
+			}
+			if msgs := writtenMsgs(userConn(friend)); len(msgs) != 1 {
+				tt.Errorf("expected friend to be notified only once, got %v", msgs)
+			}
+		})
+	}
+}
+
+func TestHubShutdown(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	user1 := createOnlineUser(1, []int{2})
+	user2 := createOnlineUser(2, []int{1})
+	h.addUser(user1)
+	h.addUser(user2)
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("could not shutdown hub: %v", err)
+	}
+	conns := []*ConnContext{userConn(user1), userConn(user2)}
+	// Connections are closed by transport after hub shutdown.
+	h.DisconnectHandler(conns[0])
+	login, _ := types.EncodeMsg(types.CmdLogin, &types.LoginRequest{UserID: 3})
+	connCtx := createConnContext()
+	h.IncomingMessageHandler(connCtx, types.DecodeMsg(login))
+	done <- struct{}{}
+
+	for i, conn := range conns {
+		msgs := writtenMsgs(conn)
+		if len(msgs) != 1 || msgs[0].Cmd != types.CmdGoingAway {
+			t.Errorf("expected only going away message for user %d, got %v", i+1, msgs)
+		}
+	}
+	if _, ok := h.users[3]; ok {
+		t.Error("expected login to be rejected during shutdown")
+	}
+	if msgs := writtenMsgs(connCtx); len(msgs) != 1 || msgs[0].Cmd != types.CmdError {
+		t.Errorf("expected error reply for login during shutdown, got %v", msgs)
+	}
 }
 
 func TestHubRemoveOfflineUsers(t *testing.T) {
@@ -69,11 +934,9 @@ func TestHubRemoveOfflineUsers(t *testing.T) {
 	user1 := createOnlineUser(1, []int{2, 3})
 	user2 := createOnlineUser(2, []int{1})
 	user3 := createOnlineUser(3, []int{1})
-	h.users = map[int]*User{
-		1: user1,
-		2: user2,
-		3: user3,
-	}
+	h.addUser(user1)
+	h.addUser(user2)
+	h.addUser(user3)
 
 	mockTicker <- time.Now()
 	done <- struct{}{}
@@ -83,6 +946,71 @@ func TestHubRemoveOfflineUsers(t *testing.T) {
 	}
 }
 
+func TestHubRemoveOnlyExpiredUsers(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	user1 := createOnlineUser(1, []int{2})
+	user2 := createOnlineUser(2, []int{1})
+	h.addUser(user1)
+	h.addUser(user2)
+	ping, _ := types.EncodeMsg(types.CmdPing, &types.PingRequest{UserID: 2})
+
+	h.IncomingMessageHandler(userConn(user2), types.DecodeMsg(ping))
+	mockTicker <- time.Now()
+	done <- struct{}{}
+
+	if _, ok := h.users[1]; ok {
+		t.Error("expected user without pings to be removed")
+	}
+	if _, ok := h.users[2]; !ok {
+		t.Error("expected pinging user to stay online")
+	}
+	if len(h.timeouts) != 1 || h.timeouts[0] != userSession(user2) {
+		t.Errorf("expected only user 2 in timeouts queue, got %v", h.timeouts)
+	}
+	if msgs := writtenMsgs(userConn(user2)); len(msgs) != 1 || msgs[0].Cmd != types.CmdStatusChange {
+		t.Errorf("expected user 2 to be notified about user 1, got %v", msgs)
+	}
+}
+
+func TestHubSortsFriends(t *testing.T) {
+	h := NewHub()
+	mockTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go h.Run(mockTicker, done)
+	b, _ := types.EncodeMsg(types.CmdLogin, &types.LoginRequest{UserID: 1, Friends: []int{3, 2, 3}})
+	h.IncomingMessageHandler(createConnContext(), types.DecodeMsg(b))
+	done <- struct{}{}
+
+	if friends := h.users[1].Friends; !reflect.DeepEqual(friends, []int{2, 3}) {
+		t.Fatalf("expected sorted friends without duplicates, got %v", friends)
+	}
+	if !h.lists(1, 3) || h.lists(1, 4) || h.lists(2, 1) {
+		t.Error("expected only online user 1 to list user 3")
+	}
+}
+
+// benchmarkUsers is a number of online users in hub benchmarks.
+const benchmarkUsers = 20000
+
+// createBenchmarkHub creates hub where each user has given number of
+// friends. Deadlines are in the future so users don't expire.
+func createBenchmarkHub(friendsCount int) *Hub {
+	h := NewHub()
+	for i := 0; i < benchmarkUsers; i++ {
+		friends := make([]int, 0, friendsCount)
+		for j := 1; j <= friendsCount; j++ {
+			friends = append(friends, (i+j)%benchmarkUsers)
+		}
+		user := createOnlineUser(i, friends)
+		userSession(user).LastPingTime = time.Now().Add(10 * time.Second)
+		h.addUser(user)
+	}
+	return h
+}
+
 // BenchmarkCheckUsersState shows that current user data structure
 // there each user holds friends as int array can be improved and instead
 // friends could be linked as linkedList, map or bitmap for better performance.
@@ -99,13 +1027,15 @@ func BenchmarkCheckUsersState(b *testing.B) {
 			}
 		}
 		user := createOnlineUser(i, friends)
-		user.LastPingTime = time.Now().Add(10 * time.Second)
-		h.users[i] = user
+		userSession(user).LastPingTime = time.Now().Add(10 * time.Second)
+		h.addUser(user)
 	}
 
 	// Make some users offline.
 	for i := 0; i < offlineUsers; i++ {
-		h.users[i].LastPingTime = time.Now().Add(-10 * time.Second)
+		s := userSession(h.users[i])
+		s.LastPingTime = time.Now().Add(-10 * time.Second)
+		heap.Fix(&h.timeouts, s.timeoutIndex)
 	}
 
 	b.ResetTimer()
@@ -115,32 +1045,126 @@ func BenchmarkCheckUsersState(b *testing.B) {
 	}
 }
 
+// BenchmarkCheckUsersStateNoneExpired measures a check tick when nobody
+// has expired, it should not depend on the number of online users.
+func BenchmarkCheckUsersStateNoneExpired(b *testing.B) {
+	h := createBenchmarkHub(100)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		h.checkUsersState()
+	}
+}
+
+// BenchmarkCheckUsersStateExpired measures a check tick which
+// disconnects some users and notifies their friends.
+func BenchmarkCheckUsersStateExpired(b *testing.B) {
+	const expiredUsers = 10
+	h := createBenchmarkHub(100)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		var expired []*Session
+		for j := 0; j < expiredUsers; j++ {
+			s := userSession(h.users[(i*expiredUsers+j)%benchmarkUsers])
+			s.LastPingTime = time.Now().Add(-10 * time.Second)
+			heap.Fix(&h.timeouts, s.timeoutIndex)
+			expired = append(expired, s)
+		}
+		b.StartTimer()
+
+		h.checkUsersState()
+
+		b.StopTimer()
+		for _, s := range expired {
+			s.User.Online = true
+			s.User.Sessions = map[*ConnContext]*Session{s.Conn: s}
+			s.LastPingTime = time.Now().Add(10 * time.Second)
+			h.addUser(s.User)
+		}
+		b.StartTimer()
+	}
+}
+
+// BenchmarkNotifyFriends measures status fan-out of a user with
+// a big friends list where only a few friends are online.
+func BenchmarkNotifyFriends(b *testing.B) {
+	const onlineFriends = 100
+	h := NewHub()
+	friends := make([]int, 0, benchmarkUsers)
+	for i := 1; i <= benchmarkUsers; i++ {
+		friends = append(friends, i)
+	}
+	user := createOnlineUser(0, friends)
+	h.addUser(user)
+	for i := 1; i <= onlineFriends; i++ {
+		h.addUser(createOnlineUser(i*(benchmarkUsers/onlineFriends), nil))
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := h.notifyFriends(user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func createConnContext() *ConnContext {
 	return &ConnContext{tcpConn: &mockTCPConn{}}
 }
 
+// createOnlineUser creates user with a single session. Session has
+// no pings yet so it expires on the next check.
 func createOnlineUser(userID int, friends []int) *User {
+	s := &Session{Conn: createConnContext()}
 	return &User{
-		UserID:  userID,
-		Online:  true,
-		Friends: friends,
-		Conn:    createConnContext(),
+		UserID:   userID,
+		Online:   true,
+		Friends:  sortFriends(friends),
+		Sessions: map[*ConnContext]*Session{s.Conn: s},
+		Presence: types.PresenceOnline,
 	}
 }
 
+// userSession returns any session of the user.
+func userSession(u *User) *Session {
+	for _, s := range u.Sessions {
+		return s
+	}
+	return nil
+}
+
+func userConn(u *User) *ConnContext {
+	return userSession(u).Conn
+}
+
 type mockTCPConn struct {
 	// Embed net.Conn so we don't need to implement all methods.
 	net.Conn
+	written []*types.Msg
+	closed  bool
 }
 
-func (mockTCPConn) Close() error {
+func (c *mockTCPConn) Close() error {
+	c.closed = true
 	return nil
 }
 
-func (mockTCPConn) SetWriteDeadline(t time.Time) error {
+func (*mockTCPConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
-func (mockTCPConn) Write(b []byte) (int, error) {
-	return 0, nil
+func (c *mockTCPConn) Write(b []byte) (int, error) {
+	msg := types.DecodeMsg(b)
+	if types.IsFrame(b) {
+		msg, _ = types.DecodeFrame(b)
+	}
+	c.written = append(c.written, msg)
+	return len(b), nil
+}
+
+// writtenMsgs returns all messages written to the given connection.
+func writtenMsgs(ctx *ConnContext) []*types.Msg {
+	return ctx.tcpConn.(*mockTCPConn).written
 }
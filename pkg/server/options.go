@@ -0,0 +1,164 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// Option configures TCP/UDP/WebSocket server.
+type Option func(*options)
+
+type options struct {
+	codec types.Codec
+	tls   *tls.Config
+	// requireEncryption rejects UDP clients which
+	// don't agree on keys during handshake.
+	requireEncryption bool
+	// idleTimeout is how long UDP server keeps
+	// sessions of clients which send nothing.
+	idleTimeout time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{codec: types.JSON, idleTimeout: defaultIdleTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithCodec sets payload codec used for clients talking in frames.
+// Legacy newline clients always use JSON.
+func WithCodec(c types.Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithTLS makes TCP server accept only TLS connections.
+// UDP and WebSocket servers ignore it.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tls = config
+	}
+}
+
+// WithRequiredEncryption makes UDP server reject clients which don't
+// seal datagrams. Clients could ask for encryption without it too.
+// TCP and WebSocket servers ignore it.
+func WithRequiredEncryption() Option {
+	return func(o *options) {
+		o.requireEncryption = true
+	}
+}
+
+// WithIdleTimeout sets how long UDP server keeps sessions of clients
+// which send nothing, non positive timeouts are ignored. TCP and
+// WebSocket servers ignore it.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.idleTimeout = d
+		}
+	}
+}
+
+// HubOption configures Hub.
+type HubOption func(*hubOptions)
+
+type hubOptions struct {
+	// graph resolves friends on login. Friends lists sent
+	// by clients are trusted if graph is not set.
+	graph FriendGraph
+	// mutual delivers status changes only between users
+	// who have each other in their friends lists.
+	mutual bool
+	// loginPolicy decides what happens when already
+	// online user logs in from another connection.
+	loginPolicy LoginPolicy
+	// auth verifies login tokens. Logins are
+	// not authenticated if it is not set.
+	auth Authenticator
+}
+
+func newHubOptions(opts []HubOption) hubOptions {
+	var o hubOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithFriendGraph makes hub resolve friends from the given graph.
+// Friends list sent by client can only narrow down graph friends.
+func WithFriendGraph(g FriendGraph) HubOption {
+	return func(o *hubOptions) {
+		o.graph = g
+	}
+}
+
+// WithMutualFriendship makes presence visible only between users who
+// list each other as friends. By default user's status is sent to all
+// users from his friends list.
+func WithMutualFriendship() HubOption {
+	return func(o *hubOptions) {
+		o.mutual = true
+	}
+}
+
+// WithAuthenticator makes hub reject logins which
+// could not be authenticated by the given authenticator.
+func WithAuthenticator(a Authenticator) HubOption {
+	return func(o *hubOptions) {
+		o.auth = a
+	}
+}
+
+// LoginPolicy describes how hub handles login of a user who is already
+// logged in from another connection.
+type LoginPolicy int
+
+const (
+	// AllowMultiple keeps all user's sessions, e.g. one per device.
+	AllowMultiple LoginPolicy = iota
+	// RejectNew replies error to the new connection and keeps
+	// existing sessions.
+	RejectNew
+	// KickOld sends kicked message to existing sessions and closes
+	// their connections, so only the newest login stays.
+	KickOld
+)
+
+var loginPolicyNames = [...]string{
+	AllowMultiple: "allow-multiple",
+	RejectNew:     "reject-new",
+	KickOld:       "kick-old",
+}
+
+// ParseLoginPolicy returns login policy by its name.
+func ParseLoginPolicy(name string) (LoginPolicy, error) {
+	for p, n := range loginPolicyNames {
+		if n == name {
+			return LoginPolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown login policy %q", name)
+}
+
+func (p LoginPolicy) String() string {
+	if p >= 0 && int(p) < len(loginPolicyNames) {
+		return loginPolicyNames[p]
+	}
+	return fmt.Sprintf("LoginPolicy(%d)", int(p))
+}
+
+// WithLoginPolicy sets how duplicate logins are handled.
+// AllowMultiple is used by default.
+func WithLoginPolicy(p LoginPolicy) HubOption {
+	return func(o *hubOptions) {
+		o.loginPolicy = p
+	}
+}
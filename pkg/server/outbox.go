@@ -0,0 +1,129 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+const (
+	// retransmitTimeout is how long server waits for the first
+	// acknowledgement, it is doubled after each retransmission.
+	retransmitTimeout    = 100 * time.Millisecond
+	maxRetransmitTimeout = time.Second
+	// maxTransmissions limits how many times message is sent
+	// before server gives up on the client and ends its session.
+	maxTransmissions = 8
+)
+
+// outbox keeps messages sent to UDP client until they are acknowledged
+// and retransmits them with exponential backoff. Hub sends messages
+// while acknowledgements come from the read loop, so it is guarded by mutex.
+type outbox struct {
+	conn *ConnContext
+	// expired is called when message was not acknowledged
+	// in time, client's session should be ended then.
+	expired func()
+
+	mu      sync.Mutex
+	closed  bool
+	lastSeq uint64
+	// pending holds retransmit timers by sequence number.
+	pending map[uint64]*time.Timer
+}
+
+func newOutbox(conn *ConnContext) *outbox {
+	return &outbox{conn: conn, pending: make(map[uint64]*time.Timer)}
+}
+
+// send wraps frame with the next sequence number and writes it.
+func (o *outbox) send(frame []byte) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.lastSeq++
+	seq := o.lastSeq
+	b := types.EncodeSequenced(seq, frame)
+	o.schedule(seq, b, 1, retransmitTimeout)
+	o.mu.Unlock()
+
+	return o.conn.writeSealed(b)
+}
+
+// schedule retransmits message after timeout unless it is acknowledged.
+// It must be called with mu held.
+func (o *outbox) schedule(seq uint64, b []byte, transmissions int, timeout time.Duration) {
+	o.pending[seq] = time.AfterFunc(timeout, func() {
+		o.retransmit(seq, b, transmissions, timeout)
+	})
+}
+
+func (o *outbox) retransmit(seq uint64, b []byte, transmissions int, timeout time.Duration) {
+	o.mu.Lock()
+	if _, ok := o.pending[seq]; !ok || o.closed {
+		o.mu.Unlock()
+		return
+	}
+	if transmissions >= maxTransmissions {
+		// Client missed the message, so its view of friends is stale and
+		// later messages make no sense either. All of them are dropped and
+		// session is ended, client gets a fresh snapshot once it logs in again.
+		o.dropPending()
+		expired := o.expired
+		o.mu.Unlock()
+		logrus.Errorf("message %d to %s was not acknowledged, ending session", seq, o.conn.remoteAddr())
+		if expired != nil {
+			expired()
+		}
+		return
+	}
+	timeout *= 2
+	if timeout > maxRetransmitTimeout {
+		timeout = maxRetransmitTimeout
+	}
+	o.schedule(seq, b, transmissions+1, timeout)
+	o.mu.Unlock()
+
+	if err := o.conn.writeSealed(b); err != nil {
+		logrus.Errorf("could not retransmit message %d to %s: %v", seq, o.conn.remoteAddr(), err)
+	}
+}
+
+// ack stops retransmitting acknowledged message.
+func (o *outbox) ack(seq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if t, ok := o.pending[seq]; ok {
+		t.Stop()
+		delete(o.pending, seq)
+	}
+}
+
+// empty reports if no messages are waiting for acknowledgement.
+func (o *outbox) empty() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending) == 0
+}
+
+// stop drops all pending messages.
+func (o *outbox) stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	o.dropPending()
+}
+
+// dropPending stops retransmitting all messages.
+// It must be called with mu held.
+func (o *outbox) dropPending() {
+	for seq, t := range o.pending {
+		t.Stop()
+		delete(o.pending, seq)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+func TestOutboxRetransmitsUntilAck(t *testing.T) {
+	p := &mockPacketConn{}
+	ctx := &ConnContext{udpConn: p, framed: true}
+	ctx.outbox = newOutbox(ctx)
+
+	if err := ctx.send(types.CmdStatusChange, &types.StatusChangeReply{UserID: 1, Online: true}); err != nil {
+		t.Fatalf("could not send message: %v", err)
+	}
+	time.Sleep(retransmitTimeout + retransmitTimeout/2)
+	ctx.outbox.ack(1)
+	time.Sleep(2 * retransmitTimeout)
+
+	written := p.writtenPackets()
+	if len(written) != 2 {
+		t.Fatalf("expected message and one retransmission, got %d packets", len(written))
+	}
+	for _, b := range written {
+		msg, err := types.DecodeFrame(b)
+		if err != nil || msg.Cmd != types.CmdSequenced {
+			t.Fatalf("expected sequenced frame, got %v %v", msg, err)
+		}
+		seq, inner, err := types.DecodeSequenced(msg.Data)
+		if err != nil || seq != 1 || inner.Cmd != types.CmdStatusChange {
+			t.Errorf("expected status change with sequence 1, got %d %v %v", seq, inner, err)
+		}
+	}
+}
+
+func TestOutboxStop(t *testing.T) {
+	p := &mockPacketConn{}
+	ctx := &ConnContext{udpConn: p, framed: true}
+	ctx.outbox = newOutbox(ctx)
+
+	ctx.send(types.CmdStatusChange, &types.StatusChangeReply{UserID: 1})
+	ctx.close()
+	ctx.send(types.CmdStatusChange, &types.StatusChangeReply{UserID: 1})
+	time.Sleep(2 * retransmitTimeout)
+
+	if written := p.writtenPackets(); len(written) != 1 {
+		t.Errorf("expected no messages after connection is closed, got %d packets", len(written))
+	}
+}
+
+func TestOutboxExpiresWhenNotAcknowledged(t *testing.T) {
+	p := &mockPacketConn{}
+	ctx := &ConnContext{udpConn: p, framed: true}
+	ctx.outbox = newOutbox(ctx)
+	expired := make(chan struct{}, 2)
+	ctx.outbox.expired = func() { expired <- struct{}{} }
+
+	ctx.send(types.CmdStatusChange, &types.StatusChangeReply{UserID: 1})
+	ctx.send(types.CmdStatusChange, &types.StatusChangeReply{UserID: 2})
+	b := p.writtenPackets()[0]
+	ctx.outbox.retransmit(1, b, maxTransmissions, maxRetransmitTimeout)
+
+	select {
+	case <-expired:
+	default:
+		t.Fatal("expected session to expire")
+	}
+	ctx.outbox.retransmit(2, b, maxTransmissions, maxRetransmitTimeout)
+	if len(expired) != 0 {
+		t.Error("expected session to expire once")
+	}
+	ctx.outbox.mu.Lock()
+	pending := len(ctx.outbox.pending)
+	ctx.outbox.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("expected pending messages to be dropped, got %d", pending)
+	}
+
+	// Client could log in again, so new messages are still sent.
+	ctx.send(types.CmdLoginAccepted, &types.LoginAcceptedReply{})
+	if written := p.writtenPackets(); len(written) != 3 {
+		t.Errorf("expected message after expiry to be sent, got %d packets", len(written))
+	}
+}
+
+type mockPacketConn struct {
+	// Embed net.PacketConn so we don't need to implement all methods.
+	net.PacketConn
+
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (*mockPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *mockPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, b)
+	return len(b), nil
+}
+
+func (c *mockPacketConn) writtenPackets() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"sync"
 
 	"github.com/anjmao/friends/pkg/types"
 )
@@ -10,11 +12,40 @@ import (
 type Friends interface {
 	ListenAndServe(addr string) error
 	Handle(handler ConnHandler)
+	HandleDisconnect(handler DisconnectHandler)
+	// Shutdown closes listeners and client connections and waits for
+	// connection handlers to finish or given context to be done.
+	Shutdown(ctx context.Context) error
 }
 
 var (
+	// ErrServerClosed is returned by ListenAndServe after Shutdown.
+	ErrServerClosed = errors.New("server closed")
+
 	errHandlerNotRegistered = errors.New("handler is not registered")
 )
 
 // ConnHandler abstracts incoming data handling for TCP/UDP protocols.
 type ConnHandler func(ctx *ConnContext, msg *types.Msg)
+
+// DisconnectHandler is called when transport knows that connection is
+// terminated. Connectionless transports may never call it and rely on
+// ping timeouts instead.
+type DisconnectHandler func(ctx *ConnContext)
+
+// wait waits for the wait group or returns context error
+// if context is done first.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
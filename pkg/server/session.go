@@ -0,0 +1,69 @@
+package server
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// Session is a single logged in connection of a user, e.g. one
+// of his devices. User is online while he has at least one session.
+type Session struct {
+	User         *User
+	Conn         *ConnContext
+	LastPingTime time.Time
+
+	// timeoutIndex is session position in hub timeouts queue.
+	timeoutIndex int
+}
+
+// send sends message to all user's sessions.
+func (u *User) send(cmd types.CommandType, v interface{}) error {
+	var writeErr error
+	for _, s := range u.Sessions {
+		if err := s.Conn.send(cmd, v); err != nil {
+			writeErr = err
+		}
+	}
+	return writeErr
+}
+
+// session returns user's session which uses given connection.
+func (h *Hub) session(userID int, conn *ConnContext) (*Session, bool) {
+	u, ok := h.users[userID]
+	if !ok {
+		return nil, false
+	}
+	s, ok := u.Sessions[conn]
+	return s, ok
+}
+
+// addSession stores session of already known user.
+func (h *Hub) addSession(s *Session) {
+	if s.User.Sessions == nil {
+		s.User.Sessions = make(map[*ConnContext]*Session)
+	}
+	s.User.Sessions[s.Conn] = s
+	h.conns[s.Conn] = s.User.UserID
+	heap.Push(&h.timeouts, s)
+}
+
+// removeSession forgets session, user stays online even if it
+// was his last session.
+func (h *Hub) removeSession(s *Session) {
+	delete(s.User.Sessions, s.Conn)
+	if userID, ok := h.conns[s.Conn]; ok && userID == s.User.UserID {
+		delete(h.conns, s.Conn)
+	}
+	heap.Remove(&h.timeouts, s.timeoutIndex)
+}
+
+// endSession removes session and marks user offline
+// if it was his last session.
+func (h *Hub) endSession(s *Session) {
+	h.removeSession(s)
+	if len(s.User.Sessions) == 0 {
+		h.setOffline(s.User)
+	}
+}
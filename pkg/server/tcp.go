@@ -2,18 +2,36 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/anjmao/friends/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
-func NewTCPServer() Friends {
-	return &TCPServer{}
+// shutdownLinger limits how long connections are read on shutdown
+// waiting for clients to close them.
+const shutdownLinger = 500 * time.Millisecond
+
+func NewTCPServer(opts ...Option) Friends {
+	return &TCPServer{opts: newOptions(opts)}
 }
 
 type TCPServer struct {
-	handler ConnHandler
+	opts       options
+	handler    ConnHandler
+	disconnect DisconnectHandler
+
+	mu       sync.Mutex
+	closed   bool
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	// handlers tracks running connection handlers.
+	handlers sync.WaitGroup
 }
 
 // ListenAndServe starts listening and accepting new TCP connections.
@@ -26,31 +44,182 @@ func (s *TCPServer) ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(ln)
+}
+
+// Serve accepts TCP connections on the given listener. It is useful
+// to serve listener which is created by the caller, e.g. in tests.
+func (s *TCPServer) Serve(ln net.Listener) error {
+	if s.handler == nil {
+		return errHandlerNotRegistered
+	}
+	if s.opts.tls != nil {
+		ln = tls.NewListener(ln, s.opts.tls)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.mu.Unlock()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			logrus.Errorf("failed to accept new conn: %v", err)
 			break
 		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
 		go s.handleConnection(conn)
 	}
 	return nil
 }
 
+// Shutdown stops accepting new connections, closes active ones and
+// waits for their handlers to finish. Hub should be shut down first
+// so clients get notified before connections are closed.
+//
+// Closing connection with unread data resets it and client could lose
+// messages sent just before, e.g. going away. So connections are only
+// closed for writing and handlers read until client closes too, or
+// until linger time or context deadline passes, whichever is first.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	deadline := lingerDeadline(ctx)
+
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		closeWrite(conn)
+		conn.SetReadDeadline(deadline)
+	}
+	s.mu.Unlock()
+
+	if waitErr := wait(ctx, &s.handlers); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// lingerDeadline returns until when connections are read on shutdown.
+func lingerDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(shutdownLinger)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// closeWrite shuts down writing side of connection,
+// connection is closed if it does not support that.
+func closeWrite(conn net.Conn) {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		conn.Close()
+	}
+}
+
+func (s *TCPServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// trackConn remembers active connection so it can be closed on shutdown.
+// It returns false if server is already closed.
+func (s *TCPServer) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *TCPServer) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
 // Handle registers global handler.
 func (s *TCPServer) Handle(handler ConnHandler) {
 	s.handler = handler
 }
 
+// HandleDisconnect registers handler which is called when
+// client closes connection or connection breaks.
+func (s *TCPServer) HandleDisconnect(handler DisconnectHandler) {
+	s.disconnect = handler
+}
+
+// handleConnection reads messages until connection is closed.
+// Framing is negotiated by the first byte client sends: frame header
+// switches connection to length prefixed frames, anything else is treated
+// as legacy newline terminated messages.
 func (s *TCPServer) handleConnection(conn net.Conn) {
-	scanner := bufio.NewScanner(conn)
+	defer s.forgetConn(conn)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+
+	ctx := &ConnContext{tcpConn: conn, framed: types.IsFrame(first)}
+	if ctx.framed {
+		s.readFrames(ctx, r)
+	} else {
+		s.readLines(ctx, r)
+	}
+
+	if s.disconnect != nil {
+		s.disconnect(ctx)
+	}
+}
+
+func (s *TCPServer) readFrames(ctx *ConnContext, r *bufio.Reader) {
+	dec := types.NewDecoder(r)
+	for {
+		msg, err := dec.Decode()
+		if err != nil {
+			// Read deadline is set on shutdown.
+			if err != io.EOF && !s.isClosed() {
+				logrus.Errorf("could not decode frame: %v", err)
+			}
+			return
+		}
+		dispatch(ctx, msg, s.opts, s.handler)
+	}
+}
+
+func (s *TCPServer) readLines(ctx *ConnContext, r *bufio.Reader) {
+	scanner := bufio.NewScanner(r)
 	for {
 		if ok := scanner.Scan(); !ok {
 			return
 		}
 
 		msg := types.DecodeMsg(scanner.Bytes())
-		s.handler(&ConnContext{tcpConn: conn}, msg)
+		dispatch(ctx, msg, s.opts, s.handler)
 	}
 }
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+func TestTCPShutdownWaitsForClientToClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewTCPServer().(*TCPServer)
+	s.Handle(func(*ConnContext, *types.Msg) {})
+	go s.Serve(ln)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ping, _ := types.EncodeMsg(types.CmdPing, &types.PingRequest{UserID: 1})
+	if _, err := conn.Write(ping); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	// Server stops writing, but still reads what client sends.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after server closed writing, got %v", err)
+	}
+	if _, err := conn.Write(ping); err != nil {
+		t.Fatalf("expected connection to stay open for writing, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected shutdown to wait for client, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("expected shutdown to succeed, got %v", err)
+		}
+	case <-time.After(shutdownLinger / 2):
+		t.Error("expected shutdown to finish once client closed connection")
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import "time"
+
+// timeoutQueue is a min heap of sessions ordered by ping deadline,
+// so each check only looks at sessions whose pings are overdue.
+// It implements heap.Interface and keeps Session.timeoutIndex up to date.
+type timeoutQueue []*Session
+
+func (q timeoutQueue) Len() int {
+	return len(q)
+}
+
+func (q timeoutQueue) Less(i, j int) bool {
+	return q[i].LastPingTime.Before(q[j].LastPingTime)
+}
+
+func (q timeoutQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].timeoutIndex = i
+	q[j].timeoutIndex = j
+}
+
+func (q *timeoutQueue) Push(x interface{}) {
+	s := x.(*Session)
+	s.timeoutIndex = len(*q)
+	*q = append(*q, s)
+}
+
+func (q *timeoutQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.timeoutIndex = -1
+	*q = old[:n-1]
+	return s
+}
+
+// expired returns session with the earliest deadline if it has passed.
+func (q timeoutQueue) expired(now time.Time) (*Session, bool) {
+	if len(q) == 0 {
+		return nil, false
+	}
+	s := q[0]
+	return s, s.LastPingTime.Add(pingWaitTime).Before(now)
+}
@@ -1,20 +1,55 @@
 package server
 
 import (
-	"github.com/sirupsen/logrus"
+	"context"
+	"fmt"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
+	"github.com/anjmao/friends/pkg/secure"
 	"github.com/anjmao/friends/pkg/types"
 )
 
-const udpBufferSize = 65507
+const (
+	udpBufferSize = 65507
+	// defaultIdleTimeout is much longer than ping timeout,
+	// so users are normally logged out by the hub first.
+	defaultIdleTimeout = time.Minute
+	// flushInterval is how often shutdown checks
+	// if clients acknowledged all messages.
+	flushInterval = 10 * time.Millisecond
+)
 
-func NewUDPServer() Friends {
-	return &UDPServer{}
+func NewUDPServer(opts ...Option) Friends {
+	return &UDPServer{
+		opts:     newOptions(opts),
+		conns:    make(map[string]*ConnContext),
+		sessions: make(map[uint64]*ConnContext),
+		outboxes: make(map[*outbox]struct{}),
+	}
 }
 
 type UDPServer struct {
-	handler ConnHandler
+	opts       options
+	handler    ConnHandler
+	disconnect DisconnectHandler
+	// conns keeps connection state such as handshake per client address
+	// and sessions keeps the same state per session ID issued in hello
+	// reply. They are only accessed from the read loop goroutine.
+	conns    map[string]*ConnContext
+	sessions map[uint64]*ConnContext
+
+	mu     sync.Mutex
+	closed bool
+	conn   net.PacketConn
+	// outboxes of remembered clients, shutdown waits
+	// for them to be acknowledged.
+	outboxes map[*outbox]struct{}
+	// reading tracks running read loop.
+	reading sync.WaitGroup
 }
 
 // ListenAndServe starts listening and accepting new UDP packets.
@@ -27,11 +62,48 @@ func (s *UDPServer) ListenAndServe(addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(p)
+}
+
+// Serve reads UDP packets from the given connection. It is
+// useful to serve connection which is wrapped, e.g. in tests.
+func (s *UDPServer) Serve(p net.PacketConn) error {
+	if s.handler == nil {
+		return errHandlerNotRegistered
+	}
 
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		p.Close()
+		return ErrServerClosed
+	}
+	s.conn = p
+	s.reading.Add(1)
+	s.mu.Unlock()
+	defer s.reading.Done()
+
+	// Read deadline wakes the loop up to expire idle
+	// clients even if nobody sends anything.
+	var nextExpiry time.Time
 	for {
+		if now := time.Now(); !now.Before(nextExpiry) {
+			s.expireIdle(now)
+			nextExpiry = now.Add(s.opts.idleTimeout / 2)
+			if err := p.SetReadDeadline(nextExpiry); err != nil {
+				logrus.Errorf("could not set read deadline: %v", err)
+			}
+		}
+
 		buffer := make([]byte, udpBufferSize)
 		n, caddr, err := p.ReadFrom(buffer)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
 		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
 			logrus.Errorf("could not read packets: %v", err)
 			break
 		}
@@ -46,7 +118,266 @@ func (s *UDPServer) Handle(handler ConnHandler) {
 	s.handler = handler
 }
 
+// Shutdown closes the socket and waits for the read loop to finish.
+// Hub should be shut down first so clients get notified before.
+//
+// Messages are not retransmitted once the socket is closed, so lost
+// going away could leave clients thinking they are online. Socket is
+// closed only after clients acknowledged all messages, or gave up on
+// them, or context is done.
+func (s *UDPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	flushErr := s.flush(ctx)
+
+	s.mu.Lock()
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	if waitErr := wait(ctx, &s.reading); waitErr != nil {
+		return waitErr
+	}
+	// Read loop is done, so conns could be accessed.
+	for _, c := range s.conns {
+		if c.outbox != nil {
+			c.outbox.stop()
+		}
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+// flush waits until clients acknowledged all messages or context is done.
+func (s *UDPServer) flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for !s.acknowledged() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// acknowledged reports if no messages are waiting for acknowledgement.
+func (s *UDPServer) acknowledged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for o := range s.outboxes {
+		if !o.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *UDPServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// HandleDisconnect registers handler which is called when client sent
+// nothing for idle timeout or did not acknowledge messages. UDP has no
+// connections, so offline users are normally detected by ping timeouts
+// before that.
+func (s *UDPServer) HandleDisconnect(handler DisconnectHandler) {
+	s.disconnect = handler
+}
+
+// expireIdle forgets clients which sent nothing for idle timeout.
+func (s *UDPServer) expireIdle(now time.Time) {
+	for _, ctx := range s.conns {
+		if now.Sub(ctx.lastSeen) > s.opts.idleTimeout {
+			logrus.Infof("client %s is idle, forgetting it", ctx.remoteAddr())
+			s.forget(ctx)
+		}
+	}
+}
+
+// expire ends session of the client which did not acknowledge messages.
+// Client state is kept, so it could log in again over the same session.
+// It is called from outbox timers, so conns must not be accessed.
+func (s *UDPServer) expire(ctx *ConnContext) {
+	if s.disconnect != nil {
+		s.disconnect(ctx)
+	}
+}
+
+// forget removes client state and tells the handler that client is gone.
+func (s *UDPServer) forget(ctx *ConnContext) {
+	if addr := ctx.remoteAddr().String(); s.conns[addr] == ctx {
+		delete(s.conns, addr)
+	}
+	if ctx.welcome != nil && s.sessions[ctx.welcome.SessionID] == ctx {
+		delete(s.sessions, ctx.welcome.SessionID)
+	}
+	if ctx.outbox != nil {
+		s.mu.Lock()
+		delete(s.outboxes, ctx.outbox)
+		s.mu.Unlock()
+	}
+	ctx.close()
+	if s.disconnect != nil {
+		s.disconnect(ctx)
+	}
+}
+
+// migrate moves client to the address its valid datagram came from, so
+// replies keep reaching it after NAT rebinding. Another client previously
+// seen at the new address is stale and forgotten.
+func (s *UDPServer) migrate(ctx *ConnContext, caddr net.Addr) {
+	addr := ctx.remoteAddr().String()
+	if addr == caddr.String() {
+		return
+	}
+	logrus.Infof("client moved from %s to %s", addr, caddr)
+	if s.conns[addr] == ctx {
+		delete(s.conns, addr)
+	}
+	if other, ok := s.conns[caddr.String()]; ok {
+		s.forget(other)
+	}
+	s.conns[caddr.String()] = ctx
+	ctx.setRemoteAddr(caddr)
+}
+
+// authenticated reports if datagram could only be sent by the client.
+// Sealed datagrams are opened with session keys. Plain clients only
+// prove themselves with session token in pings, hello never does.
+func (s *UDPServer) authenticated(ctx *ConnContext, msg *types.Msg, sealed bool) bool {
+	if sealed {
+		return true
+	}
+	if msg.Cmd != types.CmdPing || ctx.welcome == nil || ctx.welcome.Session == "" {
+		return false
+	}
+	req := new(types.PingRequest)
+	if err := ctx.unmarshal(msg.Data, req); err != nil {
+		return false
+	}
+	return ctx.ownsSession(req.Session)
+}
+
+// lookup returns state of the client which sent datagram and datagram
+// without session header. Clients are found by session ID once they
+// got it in hello reply and by address before that. State of unknown
+// clients is new and not stored yet.
+func (s *UDPServer) lookup(p net.PacketConn, data []byte, caddr net.Addr) (*ConnContext, []byte, bool) {
+	if types.IsSessionDatagram(data) {
+		id, inner, err := types.DecodeSessionDatagram(data)
+		if err != nil {
+			logrus.Errorf("could not decode session datagram from %s: %v", caddr, err)
+			return nil, nil, false
+		}
+		ctx, ok := s.sessions[id]
+		if !ok {
+			logrus.Errorf("dropped datagram of unknown session from %s", caddr)
+		}
+		return ctx, inner, ok
+	}
+
+	ctx, ok := s.conns[caddr.String()]
+	if !ok {
+		if secure.IsSealed(data) {
+			logrus.Errorf("dropped sealed datagram from unknown client %s", caddr)
+			return nil, nil, false
+		}
+		ctx = &ConnContext{udpConn: p, addr: caddr, framed: types.IsFrame(data)}
+	}
+	return ctx, data, true
+}
+
+// handlePacket decodes a single datagram. Each datagram holds exactly
+// one message which is either a frame or a legacy newline terminated
+// message. Datagrams of encrypted sessions are opened first.
 func (s *UDPServer) handlePacket(p net.PacketConn, n int, b []byte, caddr net.Addr) {
-	msg := types.DecodeMsg(b[:n])
-	s.handler(&ConnContext{udpConn: p, addr:caddr}, msg)
+	ctx, data, ok := s.lookup(p, b[:n], caddr)
+	if !ok {
+		return
+	}
+	sealed := secure.IsSealed(data)
+
+	if sealed {
+		if ctx.secure == nil {
+			logrus.Errorf("dropped sealed datagram from %s without keys", caddr)
+			return
+		}
+		var err error
+		if data, err = ctx.secure.Open(data); err != nil {
+			logrus.Errorf("could not open datagram from %s: %v", caddr, err)
+			return
+		}
+	}
+
+	msg := types.DecodeMsg(data)
+	if types.IsFrame(data) {
+		var err error
+		if msg, err = types.DecodeFrame(data); err != nil {
+			logrus.Errorf("could not decode frame from %s: %v", caddr, err)
+			return
+		}
+	}
+
+	// Hello is the only message sent in clear by encrypted
+	// clients, it is resent if reply was lost.
+	if !sealed && msg.Cmd != types.CmdHello {
+		if ctx.secure != nil {
+			logrus.Errorf("dropped plain datagram from encrypted client %s", caddr)
+			return
+		}
+		if s.opts.requireEncryption {
+			err := fmt.Errorf("command %d received without encryption", msg.Cmd)
+			logrus.Error(err)
+			ctx.sendError(msg.Cmd, types.ErrCodeHandshakeRequired, err)
+			return
+		}
+	}
+
+	// Anyone could put known session ID in front of a datagram, so
+	// only authenticated datagrams prove the client moved.
+	if s.authenticated(ctx, msg, sealed) {
+		s.migrate(ctx, caddr)
+	}
+	if ctx.remoteAddr().String() == caddr.String() {
+		ctx.lastSeen = time.Now()
+	}
+
+	// Acknowledgements are handled by transport, hub never sees them.
+	if msg.Cmd == types.CmdAck && ctx.outbox != nil {
+		req := new(types.AckRequest)
+		if err := ctx.unmarshal(msg.Data, req); err != nil {
+			logrus.Errorf("could not parse ack from %s: %v", caddr, err)
+			return
+		}
+		ctx.outbox.ack(req.Seq)
+		return
+	}
+	outbox := ctx.outbox
+	dispatch(ctx, msg, s.opts, s.handler)
+	if msg.Cmd == types.CmdHello && ctx.welcomed {
+		if ctx.welcome.SessionID != 0 {
+			s.sessions[ctx.welcome.SessionID] = ctx
+		}
+		// Outbox is created once handshake is completed.
+		if ctx.outbox != outbox {
+			ctx.outbox.expired = func() { s.expire(ctx) }
+			s.mu.Lock()
+			s.outboxes[ctx.outbox] = struct{}{}
+			s.mu.Unlock()
+		}
+	}
+	// New clients are remembered only once they were welcomed or
+	// logged in, so spoofed and invalid datagrams leave no state.
+	if addr := ctx.remoteAddr().String(); s.conns[addr] != ctx && (ctx.welcomed || !ctx.framed && msg.Cmd == types.CmdLogin) {
+		s.conns[addr] = ctx
+	}
 }
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+)
+
+func TestUDPServerRemembersOnlyValidClients(t *testing.T) {
+	s := NewUDPServer().(*UDPServer)
+	s.Handle(func(*ConnContext, *types.Msg) {})
+	p := &mockPacketConn{}
+	caddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	ping, _ := types.EncodeFrame(types.JSON, types.CmdPing, &types.PingRequest{UserID: 1})
+	legacyPing, _ := types.EncodeMsg(types.CmdPing, &types.PingRequest{UserID: 1})
+	invalid := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated frame", ping[:len(ping)-1]},
+		{"frame before hello", ping},
+		{"legacy ping before login", legacyPing},
+		{"invalid hello", []byte{types.FrameV1, byte(types.CmdHello), 1, '{'}},
+	}
+	for _, tc := range invalid {
+		b := make([]byte, udpBufferSize)
+		n := copy(b, tc.data)
+		s.handlePacket(p, n, b, caddr)
+		if len(s.conns) != 0 {
+			t.Fatalf("%s: expected client not to be remembered, got %d", tc.name, len(s.conns))
+		}
+	}
+
+	hello, _ := types.EncodeFrame(types.JSON, types.CmdHello, &types.HelloRequest{Version: types.ProtocolVersion, Codecs: []string{"json"}})
+	b := make([]byte, udpBufferSize)
+	n := copy(b, hello)
+	s.handlePacket(p, n, b, caddr)
+	if ctx, ok := s.conns[caddr.String()]; !ok || !ctx.welcomed {
+		t.Errorf("expected welcomed client to be remembered, got %+v", ctx)
+	}
+}
+
+func TestUDPShutdownWaitsForAcknowledgements(t *testing.T) {
+	s := NewUDPServer().(*UDPServer)
+	s.Handle(func(ctx *ConnContext, msg *types.Msg) {
+		ctx.send(types.CmdGoingAway, &types.GoingAwayReply{})
+	})
+	p, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(p)
+
+	conn, err := net.Dial("udp", p.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, udpBufferSize)
+	hello, _ := types.EncodeFrame(types.JSON, types.CmdHello, &types.HelloRequest{
+		Version:  types.ProtocolVersion,
+		Codecs:   []string{"json"},
+		Features: []string{types.FeatureReliableDelivery},
+	})
+	conn.Write(hello)
+	if _, err := conn.Read(b); err != nil {
+		t.Fatalf("could not read hello reply: %v", err)
+	}
+	ping, _ := types.EncodeFrame(types.JSON, types.CmdPing, &types.PingRequest{UserID: 1})
+	conn.Write(ping)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("could not read going away: %v", err)
+	}
+	msg, err := types.DecodeFrame(b[:n])
+	if err != nil || msg.Cmd != types.CmdSequenced {
+		t.Fatalf("expected sequenced frame, got %v %v", msg, err)
+	}
+	seq, _, _ := types.DecodeSequenced(msg.Data)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected shutdown to wait for acknowledgement, got %v", err)
+	case <-time.After(retransmitTimeout / 2):
+	}
+
+	ack, _ := types.EncodeFrame(types.JSON, types.CmdAck, &types.AckRequest{Seq: seq})
+	conn.Write(ack)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("expected shutdown to succeed, got %v", err)
+		}
+	case <-time.After(retransmitTimeout):
+		t.Error("expected shutdown to finish once message was acknowledged")
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/anjmao/friends/pkg/types"
+	"github.com/anjmao/friends/pkg/websocket"
+)
+
+func NewWSServer(opts ...Option) Friends {
+	return &WSServer{opts: newOptions(opts)}
+}
+
+// WSServer implements Friends over WebSocket so browsers can connect.
+// Each WebSocket message carries a single command byte followed by the
+// payload. Connections are always framed, so clients must send hello
+// before anything else.
+type WSServer struct {
+	opts       options
+	handler    ConnHandler
+	disconnect DisconnectHandler
+
+	mu     sync.Mutex
+	closed bool
+	server *http.Server
+	conns  map[*websocket.Conn]struct{}
+	// handlers tracks running connection handlers. Upgraded connections
+	// are hijacked so http.Server doesn't wait for them on shutdown.
+	handlers sync.WaitGroup
+}
+
+// ListenAndServe starts HTTP server which upgrades requests to WebSocket.
+func (s *WSServer) ListenAndServe(addr string) error {
+	if s.handler == nil {
+		return errHandlerNotRegistered
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts HTTP connections on the given listener. It is useful
+// to serve listener which is created by the caller, e.g. in tests.
+func (s *WSServer) Serve(ln net.Listener) error {
+	if s.handler == nil {
+		return errHandlerNotRegistered
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.server = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+	srv := s.server
+	s.mu.Unlock()
+
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// Shutdown stops accepting new connections, closes active ones and
+// waits for their handlers to finish. Hub should be shut down first
+// so clients get notified before connections are closed.
+//
+// Like TCPServer, connections are not closed right away so messages
+// sent just before are not lost. Server sends close frame and closes
+// connection for writing, handlers read until client answers with
+// its close frame or until linger time or context deadline passes.
+func (s *WSServer) Shutdown(ctx context.Context) error {
+	deadline := lingerDeadline(ctx)
+
+	s.mu.Lock()
+	s.closed = true
+	srv := s.server
+	for conn := range s.conns {
+		if conn.CloseWrite() != nil {
+			conn.Close()
+		}
+		conn.SetReadDeadline(deadline)
+	}
+	s.mu.Unlock()
+
+	var err error
+	if srv != nil {
+		err = srv.Shutdown(ctx)
+	}
+	if waitErr := wait(ctx, &s.handlers); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// trackConn remembers active connection so it can be closed on shutdown.
+// It returns false if server is already closed.
+func (s *WSServer) trackConn(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[*websocket.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *WSServer) forgetConn(conn *websocket.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// Handle registers global handler.
+func (s *WSServer) Handle(handler ConnHandler) {
+	s.handler = handler
+}
+
+// HandleDisconnect registers handler which is called when
+// client closes connection or connection breaks.
+func (s *WSServer) HandleDisconnect(handler DisconnectHandler) {
+	s.disconnect = handler
+}
+
+func (s *WSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logrus.Errorf("could not upgrade connection: %v", err)
+		return
+	}
+	if !s.trackConn(conn) {
+		conn.Close()
+		return
+	}
+	s.handleConnection(conn)
+}
+
+// handleConnection reads messages until connection is closed.
+func (s *WSServer) handleConnection(conn *websocket.Conn) {
+	defer s.forgetConn(conn)
+	defer conn.Close()
+
+	ctx := &ConnContext{wsConn: conn, framed: true}
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				logrus.Errorf("could not read websocket message: %v", err)
+			}
+			break
+		}
+		if len(data) == 0 {
+			logrus.Error("empty websocket message")
+			continue
+		}
+		dispatch(ctx, types.DecodeMsg(data), s.opts, s.handler)
+	}
+
+	if s.disconnect != nil {
+		s.disconnect(ctx)
+	}
+}
+
+func (s *WSServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/types"
+	"github.com/anjmao/friends/pkg/websocket"
+)
+
+func TestWSShutdownWaitsForCloseFrame(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	s := NewWSServer().(*WSServer)
+	s.Handle(func(*ConnContext, *types.Msg) {})
+	go s.Serve(ln)
+
+	conn, err := websocket.Dial("ws://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected shutdown to wait for close frame, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Reading server's close frame answers it.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected EOF on server close frame, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("expected shutdown to succeed, got %v", err)
+		}
+	case <-time.After(shutdownLinger / 2):
+		t.Error("expected shutdown to finish once client answered close frame")
+	}
+}
@@ -0,0 +1,342 @@
+package types
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// Codec marshals message payloads. Command byte and framing are
+// handled separately, so codecs only deal with the message structs.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON is the default codec which is always supported.
+	JSON Codec = jsonCodec{}
+	// Binary is a compact codec for bandwidth sensitive clients.
+	Binary Codec = binaryCodec{}
+)
+
+// CodecByName returns codec with the given name.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range []Codec{JSON, Binary} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %s", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+var errTruncated = errors.New("binary payload is truncated")
+
+// binaryCodec encodes exported struct fields in declaration order:
+//
+//   - bool as a single byte,
+//   - signed integers as zigzag varints and unsigned as uvarints,
+//   - strings and byte slices as uvarint length followed by the bytes,
+//   - integer slices (friends lists) as uvarint count followed by sorted
+//     values where the first one is a zigzag varint and the rest are
+//     uvarint deltas from the previous value,
+//   - other slices as uvarint count followed by the elements,
+//   - nested structs as uvarint length followed by their fields.
+//
+// Struct which ends before all of its fields are read leaves remaining
+// fields zero, and bytes left after the last known field are ignored,
+// so message structs stay compatible as long as fields are only appended.
+// Integer slices come back sorted, their order is not preserved.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("could not marshal nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("could not marshal %s, struct expected", rv.Type())
+	}
+	return appendFields(nil, rv)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("could not unmarshal into %T, struct pointer expected", v)
+	}
+	r := &binaryReader{b: data}
+	return r.readFields(rv.Elem())
+}
+
+// codecFields returns indexes of struct fields which are encoded.
+func codecFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
+func appendFields(dst []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	for _, i := range codecFields(v.Type()) {
+		if dst, err = appendValue(dst, v.Field(i)); err != nil {
+			return nil, fmt.Errorf("%s: %v", v.Type().Field(i).Name, err)
+		}
+	}
+	return dst, nil
+}
+
+func appendValue(dst []byte, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(dst, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return binary.AppendUvarint(dst, v.Uint()), nil
+	case reflect.String:
+		dst = binary.AppendUvarint(dst, uint64(v.Len()))
+		return append(dst, v.String()...), nil
+	case reflect.Slice:
+		return appendSlice(dst, v)
+	case reflect.Struct:
+		fields, err := appendFields(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		dst = binary.AppendUvarint(dst, uint64(len(fields)))
+		return append(dst, fields...), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
+
+func appendSlice(dst []byte, v reflect.Value) ([]byte, error) {
+	dst = binary.AppendUvarint(dst, uint64(v.Len()))
+	switch kind := v.Type().Elem().Kind(); {
+	case kind == reflect.Uint8:
+		return append(dst, v.Bytes()...), nil
+	case isSignedInt(kind):
+		ids := make([]int64, v.Len())
+		for i := range ids {
+			ids[i] = v.Index(i).Int()
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		for i, id := range ids {
+			if i == 0 {
+				dst = binary.AppendVarint(dst, id)
+				continue
+			}
+			dst = binary.AppendUvarint(dst, uint64(id-ids[i-1]))
+		}
+		return dst, nil
+	default:
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if dst, err = appendValue(dst, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return dst, nil
+	}
+}
+
+func isSignedInt(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+type binaryReader struct {
+	b []byte
+}
+
+func (r *binaryReader) readFields(v reflect.Value) error {
+	for _, i := range codecFields(v.Type()) {
+		if len(r.b) == 0 {
+			// Sender knows fewer fields than we do.
+			return nil
+		}
+		if err := r.readValue(v.Field(i)); err != nil {
+			return fmt.Errorf("%s: %v", v.Type().Field(i).Name, err)
+		}
+	}
+	return nil
+}
+
+func (r *binaryReader) readValue(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.next(1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := r.varint()
+		if err != nil {
+			return err
+		}
+		return setInt(v, x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(x) {
+			return fmt.Errorf("value %d overflows %s", x, v.Type())
+		}
+		v.SetUint(x)
+	case reflect.String:
+		b, err := r.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		return r.readSlice(v)
+	case reflect.Struct:
+		b, err := r.lengthPrefixed()
+		if err != nil {
+			return err
+		}
+		nested := &binaryReader{b: b}
+		return nested.readFields(v)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (r *binaryReader) readSlice(v reflect.Value) error {
+	n, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	// Every element takes at least one byte, which protects
+	// from allocating huge slices for malicious lengths.
+	if n > uint64(len(r.b)) {
+		return errTruncated
+	}
+
+	kind := v.Type().Elem().Kind()
+	if kind == reflect.Uint8 {
+		b, err := r.next(int(n))
+		if err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), b...))
+		return nil
+	}
+
+	s := reflect.MakeSlice(v.Type(), int(n), int(n))
+	var prev int64
+	for i := 0; i < int(n); i++ {
+		if !isSignedInt(kind) {
+			if err := r.readValue(s.Index(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i == 0 {
+			if prev, err = r.varint(); err != nil {
+				return err
+			}
+		} else {
+			delta, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			prev += int64(delta)
+		}
+		if err := setInt(s.Index(i), prev); err != nil {
+			return err
+		}
+	}
+	v.Set(s)
+	return nil
+}
+
+func setInt(v reflect.Value, x int64) error {
+	if v.OverflowInt(x) {
+		return fmt.Errorf("value %d overflows %s", x, v.Type())
+	}
+	v.SetInt(x)
+	return nil
+}
+
+func (r *binaryReader) next(n int) ([]byte, error) {
+	if n > len(r.b) {
+		return nil, errTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+func (r *binaryReader) lengthPrefixed() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.b)) {
+		return nil, errTruncated
+	}
+	return r.next(int(n))
+}
+
+func (r *binaryReader) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.b = r.b[n:]
+	return x, nil
+}
+
+func (r *binaryReader) varint() (int64, error) {
+	x, n := binary.Varint(r.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.b = r.b[n:]
+	return x, nil
+}
@@ -0,0 +1,189 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		out      func() interface{}
+		expected interface{}
+	}{
+		{
+			v:        &LoginRequest{UserID: 1, Friends: []int{2, 300, 4, -5}},
+			out:      func() interface{} { return new(LoginRequest) },
+			expected: &LoginRequest{UserID: 1, Friends: []int{-5, 2, 4, 300}},
+		},
+		{
+			v:        &PingRequest{UserID: 1},
+			out:      func() interface{} { return new(PingRequest) },
+			expected: &PingRequest{UserID: 1},
+		},
+		{
+			v:        &StatusChangeReply{UserID: 1, Online: true},
+			out:      func() interface{} { return new(StatusChangeReply) },
+			expected: &StatusChangeReply{UserID: 1, Online: true},
+		},
+		{
+			v:        &SetPresenceRequest{UserID: 1, Presence: PresenceBusy, Message: "in a meeting"},
+			out:      func() interface{} { return new(SetPresenceRequest) },
+			expected: &SetPresenceRequest{UserID: 1, Presence: PresenceBusy, Message: "in a meeting"},
+		},
+		{
+			v: &PresenceSnapshotReply{Friends: []StatusChangeReply{
+				{UserID: 2, Online: true},
+				{UserID: 3},
+			}},
+			out: func() interface{} { return new(PresenceSnapshotReply) },
+			expected: &PresenceSnapshotReply{Friends: []StatusChangeReply{
+				{UserID: 2, Online: true},
+				{UserID: 3},
+			}},
+		},
+	}
+
+	for _, c := range []Codec{JSON, Binary} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s %T", c.Name(), test.v), func(tt *testing.T) {
+				b, err := c.Marshal(test.v)
+				if err != nil {
+					tt.Fatalf("could not marshal: %v", err)
+				}
+				out := test.out()
+				if err := c.Unmarshal(b, out); err != nil {
+					tt.Fatalf("could not unmarshal: %v", err)
+				}
+
+				expected := test.expected
+				if c == JSON {
+					// JSON keeps friends order as is.
+					expected = test.v
+				}
+				if !reflect.DeepEqual(out, expected) {
+					tt.Fatalf("expected %+v, got %+v", expected, out)
+				}
+			})
+		}
+	}
+}
+
+func TestBinaryCodecEncodesFriendsAsDeltas(t *testing.T) {
+	b, err := Binary.Marshal(&LoginRequest{UserID: 1, Friends: []int{1000, 1001, 1003}})
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+
+	// user_id=1, 3 friends, 1000 as zigzag varint, deltas 1 and 2, invisible=false, empty token.
+	expectedOutput := "0203d00f01020000"
+	if bytesHex := fmt.Sprintf("%x", b); bytesHex != expectedOutput {
+		t.Fatalf("expected output %s, got %s", expectedOutput, bytesHex)
+	}
+}
+
+func TestBinaryCodecIsSmallerForBigFriendsLists(t *testing.T) {
+	req := &LoginRequest{UserID: 1}
+	for i := 100000; i < 105000; i++ {
+		req.Friends = append(req.Friends, i)
+	}
+
+	jsonBytes, _ := JSON.Marshal(req)
+	binaryBytes, err := Binary.Marshal(req)
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+	if len(binaryBytes)*4 > len(jsonBytes) {
+		t.Fatalf("expected binary payload to be much smaller than JSON, got %d and %d bytes", len(binaryBytes), len(jsonBytes))
+	}
+}
+
+func TestBinaryCodecAppendedFields(t *testing.T) {
+	type statusV1 struct {
+		UserID int
+		Online bool
+	}
+	type statusV2 struct {
+		UserID int
+		Online bool
+		Status string
+	}
+
+	b, err := Binary.Marshal(&statusV2{UserID: 7, Online: true, Status: "away"})
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+	old := new(statusV1)
+	if err := Binary.Unmarshal(b, old); err != nil {
+		t.Fatalf("could not unmarshal newer message: %v", err)
+	}
+	if *old != (statusV1{UserID: 7, Online: true}) {
+		t.Fatalf("unexpected message %+v", old)
+	}
+
+	b, _ = Binary.Marshal(old)
+	newer := new(statusV2)
+	if err := Binary.Unmarshal(b, newer); err != nil {
+		t.Fatalf("could not unmarshal older message: %v", err)
+	}
+	if *newer != (statusV2{UserID: 7, Online: true}) {
+		t.Fatalf("unexpected message %+v", newer)
+	}
+}
+
+func TestBinaryCodecTruncatedPayload(t *testing.T) {
+	b, _ := Binary.Marshal(&LoginRequest{UserID: 1, Friends: []int{2, 3, 4}})
+	// Cut in the middle of friends list.
+	if err := Binary.Unmarshal(b[:3], new(LoginRequest)); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, c := range []Codec{JSON, Binary} {
+		got, err := CodecByName(c.Name())
+		if err != nil || got != c {
+			t.Fatalf("expected codec %s, got %v %v", c.Name(), got, err)
+		}
+	}
+	if _, err := CodecByName("xml"); err == nil {
+		t.Fatal("expected error for unknown codec")
+	}
+}
+
+func TestCompressedCodecsRoundTrip(t *testing.T) {
+	req := &LoginRequest{UserID: 1}
+	for i := 0; i < 1000; i++ {
+		req.Friends = append(req.Friends, i)
+	}
+
+	for _, c := range []Codec{JSON, Binary} {
+		t.Run(c.Name(), func(tt *testing.T) {
+			compressed, err := Compress(c, CompressionDeflate)
+			if err != nil {
+				tt.Fatalf("could not create compressed codec: %v", err)
+			}
+			b, err := compressed.Marshal(req)
+			if err != nil {
+				tt.Fatalf("could not marshal: %v", err)
+			}
+			plain, _ := c.Marshal(req)
+			if len(b) >= len(plain) {
+				tt.Errorf("expected compressed payload to be smaller, got %d and %d bytes", len(b), len(plain))
+			}
+
+			out := new(LoginRequest)
+			if err := compressed.Unmarshal(b, out); err != nil {
+				tt.Fatalf("could not unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(out, req) {
+				tt.Fatalf("expected %v, got %v", req, out)
+			}
+		})
+	}
+
+	if _, err := Compress(JSON, "lz4"); err == nil {
+		t.Fatal("expected error for unknown compression")
+	}
+}
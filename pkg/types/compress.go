@@ -0,0 +1,70 @@
+package types
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Compression algorithms which could be negotiated during handshake.
+const (
+	CompressionNone    = "none"
+	CompressionDeflate = "deflate"
+)
+
+// Compress wraps given codec so that payloads are compressed
+// with the given algorithm after marshaling.
+func Compress(c Codec, compression string) (Codec, error) {
+	switch compression {
+	case "", CompressionNone:
+		return c, nil
+	case CompressionDeflate:
+		return deflateCodec{codec: c}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %s", compression)
+	}
+}
+
+type deflateCodec struct {
+	codec Codec
+}
+
+func (c deflateCodec) Name() string {
+	return c.codec.Name() + "+" + CompressionDeflate
+}
+
+func (c deflateCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c deflateCodec) Unmarshal(data []byte, v interface{}) error {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	// Limit decompressed size the same way as frames are limited.
+	data, err := io.ReadAll(io.LimitReader(r, MaxFrameSize+1))
+	if err != nil {
+		return fmt.Errorf("could not decompress payload: %v", err)
+	}
+	if len(data) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	return c.codec.Unmarshal(data, v)
+}
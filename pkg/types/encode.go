@@ -21,3 +21,14 @@ func EncodeMsg(cmd CommandType, v interface{}) ([]byte, error) {
 	buf.WriteByte('\n')
 	return buf.Bytes(), nil
 }
+
+// EncodeMessage encodes given command and struct using given codec without
+// any delimiter. It is used by message oriented transports like WebSocket
+// where transport itself keeps messages apart.
+func EncodeMessage(c Codec, cmd CommandType, v interface{}) ([]byte, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal message to %s: %v", c.Name(), err)
+	}
+	return append([]byte{byte(cmd)}, data...), nil
+}
@@ -50,3 +50,23 @@ func TestEncodeMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeMessageRoundTrip(t *testing.T) {
+	b, err := EncodeMessage(Binary, CmdPing, &PingRequest{UserID: 1})
+	if err != nil {
+		t.Fatalf("could not encode message: %v", err)
+	}
+	// Ping command, user_id=1 and empty session.
+	if bytesHex := fmt.Sprintf("%x", b); bytesHex != "020200" {
+		t.Fatalf("expected output 020200, got %s", bytesHex)
+	}
+
+	msg := DecodeMsg(b)
+	req := new(PingRequest)
+	if err := Binary.Unmarshal(msg.Data, req); err != nil {
+		t.Fatalf("could not decode message: %v", err)
+	}
+	if msg.Cmd != CmdPing || req.UserID != 1 {
+		t.Fatalf("unexpected message %v %+v", msg.Cmd, req)
+	}
+}
@@ -0,0 +1,188 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameV1 is the first byte of every version 1 frame. It works as both
+// magic and version and never collides with a command byte, so the
+// receiver can tell frames apart from newline terminated messages
+// by looking at the first byte of a connection or datagram.
+//
+// Frame layout: FrameV1 | command | uvarint payload length | payload.
+const FrameV1 byte = 0xF1
+
+// SessionV1 is the first byte of UDP datagrams which carry session ID
+// issued by the server in hello reply. It lets server recognize client
+// whose address changed.
+//
+// Datagram layout: SessionV1 | big endian session ID | frame or sealed packet.
+const SessionV1 byte = 0xE2
+
+const sessionHeaderSize = 1 + 8
+
+// MaxFrameSize is the biggest payload Decoder accepts.
+const MaxFrameSize = 1 << 20
+
+var (
+	ErrInvalidFrame  = errors.New("invalid frame")
+	ErrFrameTooLarge = errors.New("frame is too large")
+)
+
+// IsFrame reports whether given bytes start with a frame header.
+func IsFrame(b []byte) bool {
+	return len(b) > 0 && b[0] == FrameV1
+}
+
+// EncodeFrame encodes given command and struct into version 1 frame
+// using given codec for the payload.
+func EncodeFrame(c Codec, cmd CommandType, v interface{}) ([]byte, error) {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal message to %s: %v", c.Name(), err)
+	}
+	return appendFrame(nil, &Msg{Cmd: cmd, Data: data}), nil
+}
+
+// DecodeFrame decodes single frame which must span all given bytes.
+// It is used for datagrams where each packet holds exactly one frame.
+func DecodeFrame(b []byte) (*Msg, error) {
+	d := NewDecoder(bytes.NewReader(b))
+	msg, err := d.Decode()
+	if err == io.EOF {
+		return nil, ErrInvalidFrame
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Buffered bytes are not enough, big payloads are read
+	// past the buffer and leave trailing bytes unbuffered.
+	if _, err := d.r.ReadByte(); err != io.EOF {
+		return nil, ErrInvalidFrame
+	}
+	return msg, nil
+}
+
+// EncodeSequenced wraps frame into CmdSequenced frame. Its payload is
+// uvarint sequence number followed by the wrapped frame as is.
+func EncodeSequenced(seq uint64, frame []byte) []byte {
+	data := binary.AppendUvarint(nil, seq)
+	return appendFrame(nil, &Msg{Cmd: CmdSequenced, Data: append(data, frame...)})
+}
+
+// DecodeSequenced returns sequence number and wrapped
+// message from CmdSequenced payload.
+func DecodeSequenced(data []byte) (uint64, *Msg, error) {
+	seq, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, ErrInvalidFrame
+	}
+	msg, err := DecodeFrame(data[n:])
+	return seq, msg, err
+}
+
+// IsSessionDatagram reports whether datagram starts with session header.
+func IsSessionDatagram(b []byte) bool {
+	return len(b) > 0 && b[0] == SessionV1
+}
+
+// EncodeSessionDatagram prefixes datagram with session header.
+func EncodeSessionDatagram(session uint64, datagram []byte) []byte {
+	b := make([]byte, sessionHeaderSize, sessionHeaderSize+len(datagram))
+	b[0] = SessionV1
+	binary.BigEndian.PutUint64(b[1:], session)
+	return append(b, datagram...)
+}
+
+// DecodeSessionDatagram returns session ID and datagram without header.
+func DecodeSessionDatagram(b []byte) (uint64, []byte, error) {
+	if len(b) <= sessionHeaderSize || b[0] != SessionV1 {
+		return 0, nil, ErrInvalidFrame
+	}
+	return binary.BigEndian.Uint64(b[1:sessionHeaderSize]), b[sessionHeaderSize:], nil
+}
+
+func appendFrame(dst []byte, msg *Msg) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(msg.Data)))
+
+	dst = append(dst, FrameV1, byte(msg.Cmd))
+	dst = append(dst, lenBuf[:n]...)
+	return append(dst, msg.Data...)
+}
+
+// Encoder writes frames to the underlying stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes msg as a single frame. Frame is written with one Write
+// call so concurrent encoders over the same connection don't interleave.
+func (e *Encoder) Encode(msg *Msg) error {
+	_, err := e.w.Write(appendFrame(nil, msg))
+	return err
+}
+
+// Decoder reads frames from the underlying stream.
+type Decoder struct {
+	r       *bufio.Reader
+	maxSize uint64
+}
+
+// NewDecoder creates a decoder. Given reader is used as is if it
+// is already buffered, which allows to peek at the first byte before
+// deciding how to decode the stream.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br, maxSize: MaxFrameSize}
+}
+
+// Decode reads next frame. It returns io.EOF when stream ends cleanly
+// between frames.
+func (d *Decoder) Decode() (*Msg, error) {
+	magic, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if magic != FrameV1 {
+		return nil, fmt.Errorf("%v: unexpected version byte %#x", ErrInvalidFrame, magic)
+	}
+
+	cmd, err := d.r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size > d.maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return &Msg{Cmd: CommandType(cmd), Data: data}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
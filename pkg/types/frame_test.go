@@ -0,0 +1,164 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	b, err := EncodeFrame(JSON, CmdPing, PingRequest{UserID: 1})
+	if err != nil {
+		t.Fatalf("could not encode frame: %v", err)
+	}
+
+	expectedOutput := "f1020d7b22757365725f6964223a317d"
+	if bytesHex := fmt.Sprintf("%x", b); bytesHex != expectedOutput {
+		t.Fatalf("expected output %s, got %s", expectedOutput, bytesHex)
+	}
+}
+
+func TestFrameStreamRoundTrip(t *testing.T) {
+	msgs := []*Msg{
+		{Cmd: CmdLogin, Data: []byte("{\"user_id\":1}")},
+		{Cmd: CmdPing, Data: []byte("line\nbreaks\ninside\n")},
+		{Cmd: CmdStatusChange, Data: []byte{}},
+		{Cmd: CmdPresenceSnapshot, Data: bytes.Repeat([]byte{'x'}, 200000)},
+	}
+
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatalf("could not encode frame: %v", err)
+		}
+	}
+
+	dec := NewDecoder(buf)
+	for _, expected := range msgs {
+		msg, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("could not decode frame: %v", err)
+		}
+		if !reflect.DeepEqual(msg, expected) {
+			t.Fatalf("expected %v, got %v", expected.Cmd, msg.Cmd)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestDecodeInvalidFrames(t *testing.T) {
+	hugeHeader := []byte{FrameV1, byte(CmdPing)}
+	hugeHeader = append(hugeHeader, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint(hugeHeader[2:], MaxFrameSize+1)
+	hugeHeader = hugeHeader[:2+n]
+
+	// Payload is read past decoder buffer, so garbage after
+	// it is never buffered.
+	large := appendFrame(nil, &Msg{Cmd: CmdPing, Data: bytes.Repeat([]byte{'x'}, 10000)})
+	large = append(large, "garbage"...)
+
+	tests := []struct {
+		name  string
+		input []byte
+		err   string
+	}{
+		{name: "empty", input: []byte{}, err: ErrInvalidFrame.Error()},
+		{name: "newline message", input: []byte("\x02{}\n"), err: "unexpected version byte"},
+		{name: "truncated payload", input: []byte{FrameV1, byte(CmdPing), 5, '{'}, err: "unexpected EOF"},
+		{name: "trailing bytes", input: []byte{FrameV1, byte(CmdPing), 2, '{', '}', '\n'}, err: ErrInvalidFrame.Error()},
+		{name: "too large", input: hugeHeader, err: ErrFrameTooLarge.Error()},
+		{name: "trailing bytes after large payload", input: large, err: ErrInvalidFrame.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			_, err := DecodeFrame(test.input)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				tt.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSequencedRoundTrip(t *testing.T) {
+	frame, _ := EncodeFrame(JSON, CmdStatusChange, &StatusChangeReply{UserID: 2, Online: true})
+	b := EncodeSequenced(300, frame)
+
+	msg, err := DecodeFrame(b)
+	if err != nil || msg.Cmd != CmdSequenced {
+		t.Fatalf("expected sequenced frame, got %v %v", msg, err)
+	}
+	seq, inner, err := DecodeSequenced(msg.Data)
+	if err != nil {
+		t.Fatalf("could not decode sequenced frame: %v", err)
+	}
+	if seq != 300 || inner.Cmd != CmdStatusChange || string(inner.Data) != `{"user_id":2,"online":true}` {
+		t.Errorf("unexpected sequenced message %d %v %s", seq, inner.Cmd, inner.Data)
+	}
+
+	if _, _, err := DecodeSequenced(nil); err != ErrInvalidFrame {
+		t.Errorf("expected invalid frame error for empty payload, got %v", err)
+	}
+}
+
+func TestSessionDatagramRoundTrip(t *testing.T) {
+	frame, _ := EncodeFrame(JSON, CmdPing, &PingRequest{UserID: 1})
+	b := EncodeSessionDatagram(0x0102030405060708, frame)
+	if !IsSessionDatagram(b) || IsFrame(b) {
+		t.Fatalf("expected session datagram, got %x", b)
+	}
+	if hex.EncodeToString(b[:9]) != "e20102030405060708" {
+		t.Errorf("unexpected session header %x", b[:9])
+	}
+
+	session, datagram, err := DecodeSessionDatagram(b)
+	if err != nil {
+		t.Fatalf("could not decode session datagram: %v", err)
+	}
+	if session != 0x0102030405060708 || !bytes.Equal(datagram, frame) {
+		t.Errorf("unexpected session datagram %x %x", session, datagram)
+	}
+
+	if _, _, err := DecodeSessionDatagram(b[:9]); err != ErrInvalidFrame {
+		t.Errorf("expected invalid frame error for datagram without payload, got %v", err)
+	}
+	if _, _, err := DecodeSessionDatagram(frame); err != ErrInvalidFrame {
+		t.Errorf("expected invalid frame error for frame, got %v", err)
+	}
+}
+
+func TestSeqWindow(t *testing.T) {
+	var w SeqWindow
+	accept := func(seq uint64) bool {
+		if !w.Check(seq) {
+			return false
+		}
+		w.Update(seq)
+		return true
+	}
+
+	for _, seq := range []uint64{2, 1, 5} {
+		if !accept(seq) {
+			t.Errorf("expected %d to be accepted", seq)
+		}
+	}
+	for _, seq := range []uint64{1, 2, 5} {
+		if accept(seq) {
+			t.Errorf("expected duplicate %d to be dropped", seq)
+		}
+	}
+	if !accept(3) || !accept(5+SeqWindowSize) {
+		t.Error("expected new sequence numbers to be accepted")
+	}
+	if accept(4) {
+		t.Error("expected sequence number older than window to be dropped")
+	}
+}
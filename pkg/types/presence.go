@@ -0,0 +1,60 @@
+package types
+
+import "fmt"
+
+// Presence describes user's availability. It is encoded as
+// a string in JSON and as a number by the binary codec.
+type Presence uint8
+
+const (
+	PresenceOffline Presence = iota
+	PresenceOnline
+	PresenceAway
+	PresenceBusy
+	// PresenceInvisible user is connected but looks offline to friends.
+	PresenceInvisible
+)
+
+// MaxStatusMessageLength is the longest status message in bytes.
+const MaxStatusMessageLength = 256
+
+var presenceNames = [...]string{
+	PresenceOffline:   "offline",
+	PresenceOnline:    "online",
+	PresenceAway:      "away",
+	PresenceBusy:      "busy",
+	PresenceInvisible: "invisible",
+}
+
+// ParsePresence returns presence by its name.
+func ParsePresence(name string) (Presence, error) {
+	for p, n := range presenceNames {
+		if n == name {
+			return Presence(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown presence %q", name)
+}
+
+func (p Presence) String() string {
+	if int(p) < len(presenceNames) {
+		return presenceNames[p]
+	}
+	return fmt.Sprintf("presence(%d)", uint8(p))
+}
+
+func (p Presence) MarshalText() ([]byte, error) {
+	if int(p) >= len(presenceNames) {
+		return nil, fmt.Errorf("unknown presence %d", uint8(p))
+	}
+	return []byte(presenceNames[p]), nil
+}
+
+func (p *Presence) UnmarshalText(b []byte) error {
+	v, err := ParsePresence(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
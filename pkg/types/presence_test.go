@@ -0,0 +1,45 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPresenceJSON(t *testing.T) {
+	b, err := json.Marshal(&StatusChangeReply{UserID: 1, Online: true, Presence: PresenceAway, Message: "lunch"})
+	if err != nil {
+		t.Fatalf("could not marshal: %v", err)
+	}
+	expected := `{"user_id":1,"online":true,"presence":"away","message":"lunch"}`
+	if string(b) != expected {
+		t.Fatalf("expected %s, got %s", expected, b)
+	}
+
+	b, _ = json.Marshal(&StatusChangeReply{UserID: 1})
+	if expected := `{"user_id":1,"online":false}`; string(b) != expected {
+		t.Fatalf("expected %s, got %s", expected, b)
+	}
+
+	req := new(SetPresenceRequest)
+	if err := json.Unmarshal([]byte(`{"user_id":1,"presence":"busy"}`), req); err != nil {
+		t.Fatalf("could not unmarshal: %v", err)
+	}
+	if req.Presence != PresenceBusy {
+		t.Fatalf("expected busy presence, got %s", req.Presence)
+	}
+	if err := json.Unmarshal([]byte(`{"user_id":1,"presence":"sleeping"}`), req); err == nil {
+		t.Fatal("expected error for unknown presence")
+	}
+}
+
+func TestParsePresence(t *testing.T) {
+	for _, p := range []Presence{PresenceOffline, PresenceOnline, PresenceAway, PresenceBusy, PresenceInvisible} {
+		got, err := ParsePresence(p.String())
+		if err != nil || got != p {
+			t.Fatalf("expected presence %s, got %s %v", p, got, err)
+		}
+	}
+	if _, err := ParsePresence("sleeping"); err == nil {
+		t.Fatal("expected error for unknown presence")
+	}
+}
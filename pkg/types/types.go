@@ -1,11 +1,69 @@
 package types
 
+import "fmt"
+
 type CommandType byte
 
 const (
-	CmdLogin        CommandType = 0x1
-	CmdPing         CommandType = 0x2
-	CmdStatusChange CommandType = 0x3
+	CmdLogin            CommandType = 0x1
+	CmdPing             CommandType = 0x2
+	CmdStatusChange     CommandType = 0x3
+	CmdPresenceSnapshot CommandType = 0x4
+	CmdHello            CommandType = 0x5
+	CmdWelcome          CommandType = 0x6
+	CmdError            CommandType = 0x7
+	CmdLogout           CommandType = 0x8
+	CmdGoingAway        CommandType = 0x9
+	CmdSetPresence      CommandType = 0xA
+	CmdLastSeen         CommandType = 0xB
+	CmdLastSeenReply    CommandType = 0xC
+	CmdKicked           CommandType = 0xD
+	CmdSequenced        CommandType = 0xE // wraps a frame which client must acknowledge
+	CmdAck              CommandType = 0xF
+	CmdLoginAccepted    CommandType = 0x10
+)
+
+// ProtocolVersion is the current version of the framed protocol.
+// Legacy newline clients don't say hello and are treated as version 0.
+const ProtocolVersion = 1
+
+// Features which could be negotiated during handshake.
+const (
+	FeaturePresenceSnapshot = "presence-snapshot"
+	// FeatureReliableDelivery makes UDP server retransmit
+	// messages until client acknowledges them.
+	FeatureReliableDelivery = "reliable-delivery"
+	// FeatureLoginAccepted makes server confirm successful login,
+	// so clients know their login was not lost.
+	FeatureLoginAccepted = "login-accepted"
+)
+
+// Features lists all features known to this version of the protocol.
+var Features = []string{
+	FeaturePresenceSnapshot,
+	FeatureReliableDelivery,
+	FeatureLoginAccepted,
+}
+
+// ErrorCode describes why the server could not handle a command.
+type ErrorCode int
+
+const (
+	// ErrCodeBadRequest means message payload could not be parsed.
+	ErrCodeBadRequest ErrorCode = 1
+	// ErrCodeUnknownCommand means server does not know the command.
+	ErrCodeUnknownCommand ErrorCode = 2
+	// ErrCodeNotFound means command refers to a user who is not logged in.
+	ErrCodeNotFound ErrorCode = 3
+	// ErrCodeHandshakeRequired means command was sent before hello handshake.
+	ErrCodeHandshakeRequired ErrorCode = 4
+	// ErrCodeUnavailable means server is shutting down.
+	ErrCodeUnavailable ErrorCode = 5
+	// ErrCodeConflict means user is already logged in from another connection.
+	ErrCodeConflict ErrorCode = 6
+	// ErrCodeUnauthorized means login token is missing, invalid or expired,
+	// or ping does not carry session issued to the connection.
+	ErrCodeUnauthorized ErrorCode = 7
 )
 
 type Msg struct {
@@ -13,16 +71,136 @@ type Msg struct {
 	Data []byte
 }
 
+// LoginRequest logs user in. Invisible users see their friends
+// while friends are not told that they are online.
 type LoginRequest struct {
+	UserID    int   `json:"user_id"`
+	Friends   []int `json:"friends"`
+	Invisible bool  `json:"invisible,omitempty"`
+	// Token proves user identity if server requires authentication.
+	Token string `json:"token,omitempty"`
+}
+
+// LoginAcceptedReply confirms successful login. Friends are the ones
+// server uses, they could differ from friends sent in login request.
+type LoginAcceptedReply struct {
 	UserID  int   `json:"user_id"`
 	Friends []int `json:"friends"`
 }
 
 type PingRequest struct {
 	UserID int `json:"user_id"`
+	// Session is issued by the server in hello reply. Pings without
+	// it are rejected from clients which completed handshake.
+	Session string `json:"session,omitempty"`
+}
+
+// AckRequest acknowledges sequenced message, so server
+// stops retransmitting it.
+type AckRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// LogoutRequest tells the server that user is leaving
+// so friends are notified without waiting for ping timeout.
+type LogoutRequest struct {
+	UserID int `json:"user_id"`
 }
 
+// StatusChangeReply tells about friend's status. Presence and
+// Message are only set for online users. LastSeen is set for offline
+// users if server knows when they were online the last time.
 type StatusChangeReply struct {
-	UserID int  `json:"user_id"`
-	Online bool `json:"online"`
+	UserID   int      `json:"user_id"`
+	Online   bool     `json:"online"`
+	Presence Presence `json:"presence,omitempty"`
+	Message  string   `json:"message,omitempty"`
+	// LastSeen is unix time in seconds.
+	LastSeen int64 `json:"last_seen,omitempty"`
+}
+
+// SetPresenceRequest changes logged in user's presence and status
+// message. Offline presence is not allowed, logout should be used.
+type SetPresenceRequest struct {
+	UserID   int      `json:"user_id"`
+	Presence Presence `json:"presence"`
+	Message  string   `json:"message,omitempty"`
+}
+
+// LastSeenRequest asks for current status of the given friends
+// including last seen time of offline ones. All friends of the user
+// are returned if Friends is empty.
+type LastSeenRequest struct {
+	UserID  int   `json:"user_id"`
+	Friends []int `json:"friends,omitempty"`
+}
+
+// LastSeenReply answers LastSeenRequest. Requested users who are not
+// user's friends are left out.
+type LastSeenReply struct {
+	Friends []StatusChangeReply `json:"friends"`
+}
+
+// PresenceSnapshotReply is sent back to a freshly logged in user and
+// contains current status of every friend from his login request.
+type PresenceSnapshotReply struct {
+	Friends []StatusChangeReply `json:"friends"`
+}
+
+// HelloRequest is the first message of every framed connection.
+// Client advertises what it supports in the order of preference.
+// Hello and its reply are always encoded as JSON.
+type HelloRequest struct {
+	Version      int      `json:"version"`
+	Codecs       []string `json:"codecs"`
+	Compressions []string `json:"compressions,omitempty"`
+	Features     []string `json:"features,omitempty"`
+	// PublicKey is client's X25519 key. UDP server agrees on
+	// keys to seal datagrams with if it is set.
+	PublicKey []byte `json:"public_key,omitempty"`
+}
+
+// HelloReply contains capabilities chosen by the server. If Accepted
+// is false Reason explains why handshake was rejected and Version
+// holds protocol version supported by the server.
+type HelloReply struct {
+	Accepted    bool     `json:"accepted"`
+	Version     int      `json:"version"`
+	Codec       string   `json:"codec,omitempty"`
+	Compression string   `json:"compression,omitempty"`
+	Features    []string `json:"features,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
+	// Session is a random token which client must send back in pings,
+	// so nobody else could keep the session alive by spoofing
+	// client's address.
+	Session string `json:"session,omitempty"`
+	// PublicKey is server's X25519 key, it is set
+	// if client asked for sealed datagrams.
+	PublicKey []byte `json:"public_key,omitempty"`
+	// SessionID is issued to UDP clients which prefix every following
+	// datagram with it, so server keeps their session when client's
+	// address changes.
+	SessionID uint64 `json:"session_id,omitempty"`
+}
+
+// ErrorReply is sent when server could not handle client's command.
+type ErrorReply struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Cmd     CommandType `json:"cmd"`
+}
+
+func (e *ErrorReply) Error() string {
+	return fmt.Sprintf("server error %d for command %d: %s", e.Code, e.Cmd, e.Message)
+}
+
+// GoingAwayReply is sent to every connected user when server shuts down.
+type GoingAwayReply struct {
+	Reason string `json:"reason"`
+}
+
+// KickedReply is sent to connection before it is closed because
+// the same user logged in from another connection.
+type KickedReply struct {
+	Reason string `json:"reason"`
 }
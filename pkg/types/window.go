@@ -0,0 +1,40 @@
+package types
+
+// SeqWindowSize is how many of the latest sequence numbers
+// SeqWindow remembers.
+const SeqWindowSize = 64
+
+// SeqWindow remembers which of the latest sequence numbers were
+// received, so duplicates are dropped even if messages are reordered.
+// Sequence numbers older than the window are treated as duplicates.
+type SeqWindow struct {
+	// next is one more than the highest received sequence number.
+	next   uint64
+	bitmap uint64
+}
+
+// Check reports whether sequence number was not received yet
+// and is not too old.
+func (w *SeqWindow) Check(seq uint64) bool {
+	if seq >= w.next {
+		return true
+	}
+	diff := w.next - 1 - seq
+	return diff < SeqWindowSize && w.bitmap&(1<<diff) == 0
+}
+
+// Update marks sequence number as received.
+func (w *SeqWindow) Update(seq uint64) {
+	if seq >= w.next {
+		shift := seq + 1 - w.next
+		if shift >= SeqWindowSize {
+			w.bitmap = 0
+		} else {
+			w.bitmap <<= shift
+		}
+		w.bitmap |= 1
+		w.next = seq + 1
+		return
+	}
+	w.bitmap |= 1 << (w.next - 1 - seq)
+}
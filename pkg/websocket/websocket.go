@@ -0,0 +1,403 @@
+// Package websocket implements minimal RFC 6455 WebSocket handshake and
+// framing which is enough to exchange binary messages with browsers.
+// Extensions and subprotocols are not supported.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opcode describes WebSocket frame type.
+type Opcode byte
+
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xA
+)
+
+// MaxMessageSize is the biggest message ReadMessage accepts.
+const MaxMessageSize = 1 << 20
+
+const (
+	acceptGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	finBit           = 0x80
+	maskBit          = 0x80
+	maxControlLength = 125
+	closeTimeout     = time.Second
+)
+
+var (
+	ErrBadHandshake    = errors.New("websocket: bad handshake")
+	ErrProtocol        = errors.New("websocket: protocol error")
+	ErrMessageTooLarge = errors.New("websocket: message is too large")
+)
+
+// Conn is a WebSocket connection. ReadMessage must not be called
+// concurrently, WriteMessage is safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// client connections mask outgoing frames and expect
+	// incoming frames to be unmasked, servers do the opposite.
+	client bool
+
+	wmu            sync.Mutex
+	closeWriteOnce sync.Once
+	closeOnce      sync.Once
+}
+
+func newConn(conn net.Conn, r *bufio.Reader, client bool) *Conn {
+	return &Conn{conn: conn, r: r, client: client}
+}
+
+// Upgrade performs server side handshake and takes over HTTP connection.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("%v: unexpected method %s", ErrBadHandshake, r.Method)
+	}
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, fmt.Errorf("%v: missing upgrade headers", ErrBadHandshake)
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("%v: unsupported version", ErrBadHandshake)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return nil, fmt.Errorf("%v: missing key", ErrBadHandshake)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("%v: response does not support hijacking", ErrBadHandshake)
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial connects to WebSocket server at the given ws:// URL.
+func Dial(rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %s", u.Scheme)
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := clientHandshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+func clientHandshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+		Host: u.Host,
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("%v: unexpected status %s", ErrBadHandshake, resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%v: invalid accept key", ErrBadHandshake)
+	}
+	return newConn(conn, r, true), nil
+}
+
+// ReadMessage reads next data message joining fragmented frames. Pings are
+// answered automatically. io.EOF is returned when peer closes connection.
+func (c *Conn) ReadMessage() (Opcode, []byte, error) {
+	var (
+		msgOp Opcode
+		msg   []byte
+		inMsg bool
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case OpPing:
+			if err := c.writeFrame(OpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			// Echo close frame and let the caller close connection.
+			c.closeWrite(payload)
+			return 0, nil, io.EOF
+		case OpContinuation:
+			if !inMsg {
+				return 0, nil, fmt.Errorf("%v: unexpected continuation frame", ErrProtocol)
+			}
+		case OpText, OpBinary:
+			if inMsg {
+				return 0, nil, fmt.Errorf("%v: expected continuation frame", ErrProtocol)
+			}
+			msgOp, inMsg = op, true
+		default:
+			return 0, nil, fmt.Errorf("%v: unknown opcode %d", ErrProtocol, op)
+		}
+
+		if len(msg)+len(payload) > MaxMessageSize {
+			return 0, nil, ErrMessageTooLarge
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msgOp, msg, nil
+		}
+	}
+}
+
+// WriteMessage writes data as a single frame.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	return c.writeFrame(op, data)
+}
+
+// Close sends close frame unless it was already sent
+// and closes underlying connection.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		c.closeWrite(nil)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// CloseWrite sends close frame and shuts down writing side of underlying
+// connection, so peer gets everything written before. Peer answers with
+// close frame which ReadMessage reports as io.EOF, connection still has
+// to be closed after that.
+func (c *Conn) CloseWrite() error {
+	return c.closeWrite(nil)
+}
+
+func (c *Conn) closeWrite(payload []byte) error {
+	err := net.ErrClosed
+	c.closeWriteOnce.Do(func() {
+		c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		if err = c.writeFrame(OpClose, payload); err != nil {
+			return
+		}
+		if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+			err = cw.CloseWrite()
+		}
+	})
+	return err
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) readFrame() (fin bool, op Opcode, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&finBit != 0
+	op = Opcode(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("%v: reserved bits are set", ErrProtocol)
+	}
+
+	masked := header[1]&maskBit != 0
+	if masked == c.client {
+		// Clients must mask frames and servers must not.
+		return false, 0, nil, fmt.Errorf("%v: unexpected masking", ErrProtocol)
+	}
+
+	length := uint64(header[1] &^ maskBit)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return false, 0, nil, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if op >= OpClose && (length > maxControlLength || !fin) {
+		return false, 0, nil, fmt.Errorf("%v: invalid control frame", ErrProtocol)
+	}
+	if length > MaxMessageSize {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, mask[:]); err != nil {
+			return false, 0, nil, unexpectedEOF(err)
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return false, 0, nil, unexpectedEOF(err)
+	}
+	if masked {
+		maskBytes(mask, payload)
+	}
+	return fin, op, payload, nil
+}
+
+func (c *Conn) writeFrame(op Opcode, payload []byte) error {
+	return c.writeFrameFin(true, op, payload)
+}
+
+func (c *Conn) writeFrameFin(fin bool, op Opcode, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+14)
+	if fin {
+		frame = append(frame, finBit|byte(op))
+	} else {
+		frame = append(frame, byte(op))
+	}
+
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskFlag|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskFlag|126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func maskBytes(mask [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
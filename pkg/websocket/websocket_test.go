@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	expected := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if key := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != expected {
+		t.Fatalf("expected accept key %s, got %s", expected, key)
+	}
+}
+
+func TestEchoMessages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			t.Errorf("could not upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(op, msg); err != nil {
+				t.Errorf("could not write message: %v", err)
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := Dial("ws://" + strings.TrimPrefix(srv.URL, "http://") + "/ws")
+	if err != nil {
+		t.Fatalf("could not dial: %v", err)
+	}
+	defer conn.Close()
+
+	msgs := []struct {
+		op   Opcode
+		data []byte
+	}{
+		{op: OpBinary, data: []byte{0x1, '{', '}'}},
+		{op: OpText, data: []byte("hello")},
+		{op: OpBinary, data: bytes.Repeat([]byte{'x'}, 300)},
+		{op: OpBinary, data: bytes.Repeat([]byte{'y'}, 70000)},
+		{op: OpBinary, data: []byte{}},
+	}
+	for _, m := range msgs {
+		if err := conn.WriteMessage(m.op, m.data); err != nil {
+			t.Fatalf("could not write message: %v", err)
+		}
+		op, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("could not read message: %v", err)
+		}
+		if op != m.op || !bytes.Equal(data, m.data) {
+			t.Fatalf("expected %d message of %d bytes, got %d message of %d bytes", m.op, len(m.data), op, len(data))
+		}
+	}
+}
+
+func TestReadFragmentedMessageAndPing(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	serverConn := newConn(server, bufio.NewReader(server), false)
+	clientConn := newConn(client, bufio.NewReader(client), true)
+	// Drain pong replies.
+	go io.Copy(io.Discard, client)
+
+	go func() {
+		clientConn.writeFrameFin(false, OpBinary, []byte("hel"))
+		clientConn.writeFrame(OpPing, []byte("p"))
+		clientConn.writeFrameFin(true, OpContinuation, []byte("lo"))
+	}()
+
+	op, msg, err := serverConn.ReadMessage()
+	if err != nil {
+		t.Fatalf("could not read message: %v", err)
+	}
+	if op != OpBinary || string(msg) != "hello" {
+		t.Fatalf("expected hello binary message, got %d %q", op, msg)
+	}
+}
+
+func TestReadUnmaskedClientFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	serverConn := newConn(server, bufio.NewReader(server), false)
+	// Server side connection doesn't mask frames.
+	unmasked := newConn(client, bufio.NewReader(client), false)
+
+	go unmasked.writeFrame(OpBinary, []byte("x"))
+	if _, _, err := serverConn.ReadMessage(); err == nil || !strings.Contains(err.Error(), "masking") {
+		t.Fatalf("expected masking error, got %v", err)
+	}
+}
+
+func TestCloseFrame(t *testing.T) {
+	client, server := net.Pipe()
+	serverConn := newConn(server, bufio.NewReader(server), false)
+	clientConn := newConn(client, bufio.NewReader(client), true)
+
+	go func() {
+		clientConn.Close()
+	}()
+	if _, _, err := serverConn.ReadMessage(); err != io.EOF {
+		t.Fatalf("expected EOF on close frame, got %v", err)
+	}
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Upgrade(w, r); err == nil {
+			t.Error("expected upgrade error")
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected bad request, got %s", resp.Status)
+	}
+}
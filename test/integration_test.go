@@ -1,14 +1,17 @@
 package test
 
 import (
-	"github.com/anjmao/friends/pkg/client"
-	"github.com/anjmao/friends/pkg/server"
+	"context"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/anjmao/friends/pkg/client"
+	"github.com/anjmao/friends/pkg/server"
+	"github.com/anjmao/friends/pkg/types"
 )
 
 const (
-	serveAddr          = ":9090"
 	testWaitTime       = 10 * time.Millisecond
 	checkStateInterval = 200 * time.Millisecond
 )
@@ -27,15 +30,52 @@ func TestServerAndClientConnection(t *testing.T) {
 		clientFunc ClientFunc
 	}{
 		{
-			name:"TCP server with TCP client",
+			name:       "TCP server with TCP client",
 			serverFunc: func() server.Friends { return server.NewTCPServer() },
 			clientFunc: func() client.Friends { return client.NewTCPClient() },
 		},
 		{
-			name:"UDP server with UDP client",
+			name:       "UDP server with UDP client",
 			serverFunc: func() server.Friends { return server.NewUDPServer() },
 			clientFunc: func() client.Friends { return client.NewUDPClient() },
 		},
+		{
+			name:       "TCP server with mixed framing TCP clients",
+			serverFunc: func() server.Friends { return server.NewTCPServer() },
+			clientFunc: alternateFraming(client.NewTCPClient),
+		},
+		{
+			name:       "UDP server with mixed framing UDP clients",
+			serverFunc: func() server.Friends { return server.NewUDPServer() },
+			clientFunc: alternateFraming(client.NewUDPClient),
+		},
+		{
+			name:       "TCP server with binary codec",
+			serverFunc: func() server.Friends { return server.NewTCPServer(server.WithCodec(types.Binary)) },
+			clientFunc: func() client.Friends { return client.NewTCPClient(client.WithCodec(types.Binary)) },
+		},
+		{
+			name:       "UDP server with binary codec",
+			serverFunc: func() server.Friends { return server.NewUDPServer(server.WithCodec(types.Binary)) },
+			clientFunc: func() client.Friends { return client.NewUDPClient(client.WithCodec(types.Binary)) },
+		},
+		{
+			name:       "TCP server with compressed payloads",
+			serverFunc: func() server.Friends { return server.NewTCPServer() },
+			clientFunc: func() client.Friends {
+				return client.NewTCPClient(client.WithCodec(types.Binary), client.WithCompression(types.CompressionDeflate))
+			},
+		},
+		{
+			name:       "WebSocket server with WebSocket client",
+			serverFunc: func() server.Friends { return server.NewWSServer() },
+			clientFunc: func() client.Friends { return client.NewWSClient() },
+		},
+		{
+			name:       "WebSocket server with binary codec",
+			serverFunc: func() server.Friends { return server.NewWSServer(server.WithCodec(types.Binary)) },
+			clientFunc: func() client.Friends { return client.NewWSClient(client.WithCodec(types.Binary)) },
+		},
 	}
 
 	for _, test := range tests {
@@ -45,6 +85,432 @@ func TestServerAndClientConnection(t *testing.T) {
 	}
 }
 
+func TestClientCloseNotifiesFriendsImmediately(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	tests := []struct {
+		name       string
+		serverFunc ServerFunc
+		clientFunc ClientFunc
+	}{
+		{
+			name:       "TCP",
+			serverFunc: func() server.Friends { return server.NewTCPServer() },
+			clientFunc: func() client.Friends { return client.NewTCPClient() },
+		},
+		{
+			name:       "UDP",
+			serverFunc: func() server.Friends { return server.NewUDPServer() },
+			clientFunc: func() client.Friends { return client.NewUDPClient() },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			testClientClose(tt, test.clientFunc, test.serverFunc)
+		})
+	}
+}
+
+func testClientClose(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc) {
+	hub := server.NewHub()
+	// Never check ping timeouts so only logout or
+	// disconnect could make user offline.
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, serverFunc(), hub)
+
+	c1 := clientFunc()
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	c2 := clientFunc()
+	if err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	go c2.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	if !c2.Presence()[1].Online {
+		t.Fatalf("expected user 1 to be online, got %v", c2.Presence())
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testWaitTime)
+
+	if status, ok := c2.Presence()[1]; !ok || status.Online {
+		t.Fatalf("expected user 1 to be offline, got %v", c2.Presence())
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	tests := []struct {
+		name       string
+		serverFunc ServerFunc
+		clientFunc ClientFunc
+	}{
+		{
+			name:       "TCP",
+			serverFunc: func() server.Friends { return server.NewTCPServer() },
+			clientFunc: func() client.Friends { return client.NewTCPClient() },
+		},
+		{
+			name:       "UDP",
+			serverFunc: func() server.Friends { return server.NewUDPServer() },
+			clientFunc: func() client.Friends { return client.NewUDPClient() },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			testGracefulShutdown(tt, test.clientFunc, test.serverFunc)
+		})
+	}
+}
+
+func testGracefulShutdown(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc) {
+	hub := server.NewHub()
+	checkTicker := time.NewTicker(checkStateInterval)
+	defer checkTicker.Stop()
+	done := make(chan struct{})
+	go hub.Run(checkTicker.C, done)
+	srv := serverFunc()
+	serveAddr := startServer(t, srv, hub)
+
+	var clients []client.Friends
+	for _, u := range []string{"{\"user_id\":1, \"friends\": [2]}", "{\"user_id\":2, \"friends\": [1]}"} {
+		c := clientFunc()
+		if err := c.Connect(serveAddr, u); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		go c.PingLoop()
+		go c.ListenIncoming()
+		clients = append(clients, c)
+		time.Sleep(testWaitTime)
+	}
+	if !clients[0].Presence()[2].Online {
+		t.Fatalf("expected user 2 to be online, got %v", clients[0].Presence())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatalf("could not shutdown hub: %v", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("could not shutdown server: %v", err)
+	}
+	close(done)
+
+	time.Sleep(testWaitTime)
+	for i, c := range clients {
+		for id, status := range c.Presence() {
+			if status.Online {
+				t.Errorf("expected user %d to see friend %d offline after shutdown", i+1, id)
+			}
+		}
+	}
+}
+
+func TestTCPAndUDPServersShareHub(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := time.NewTicker(checkStateInterval)
+	defer checkTicker.Stop()
+	done := make(chan struct{})
+	go hub.Run(checkTicker.C, done)
+	t.Cleanup(func() { close(done) })
+	tcpAddr := startServer(t, server.NewTCPServer(), hub)
+	udpAddr := startServer(t, server.NewUDPServer(), hub)
+
+	tcpClient := client.NewTCPClient()
+	if err := tcpClient.Connect(tcpAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	go tcpClient.PingLoop()
+	go tcpClient.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	udpClient := client.NewUDPClient()
+	if err := udpClient.Connect(udpAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer udpClient.Close()
+	go udpClient.PingLoop()
+	go udpClient.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	if !tcpClient.Presence()[2].Online {
+		t.Errorf("expected TCP user to see UDP friend online, got %v", tcpClient.Presence())
+	}
+	if !udpClient.Presence()[1].Online {
+		t.Errorf("expected UDP user to see TCP friend online, got %v", udpClient.Presence())
+	}
+}
+
+func TestSetPresence(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	tests := []struct {
+		name       string
+		serverFunc ServerFunc
+		clientFunc ClientFunc
+	}{
+		{
+			name:       "TCP",
+			serverFunc: func() server.Friends { return server.NewTCPServer() },
+			clientFunc: func() client.Friends { return client.NewTCPClient() },
+		},
+		{
+			name:       "UDP binary codec",
+			serverFunc: func() server.Friends { return server.NewUDPServer(server.WithCodec(types.Binary)) },
+			clientFunc: func() client.Friends { return client.NewUDPClient(client.WithCodec(types.Binary)) },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			testSetPresence(tt, test.clientFunc, test.serverFunc)
+		})
+	}
+}
+
+func testSetPresence(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc) {
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, serverFunc(), hub)
+
+	c1 := clientFunc()
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2 := clientFunc()
+	if err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	go c2.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	if err := c1.SetPresence(types.PresenceAway, "lunch"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testWaitTime)
+
+	expected := types.StatusChangeReply{UserID: 1, Online: true, Presence: types.PresenceAway, Message: "lunch"}
+	if status := c2.Presence()[1]; status != expected {
+		t.Errorf("expected user 1 status %+v, got %+v", expected, status)
+	}
+
+	if err := c1.SetPresence(types.PresenceInvisible, ""); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testWaitTime)
+
+	if status := c2.Presence()[1]; status.Online {
+		t.Errorf("expected invisible user 1 to look offline, got %+v", status)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	auth := server.NewHMACAuthenticator([]byte("secret"))
+	hub := server.NewHub(server.WithAuthenticator(auth))
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, server.NewTCPServer(), hub)
+
+	c1 := client.NewTCPClient()
+	token := auth.Token(1, time.Now().Add(time.Minute))
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2], \"token\": \""+token+"\"}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go c1.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	// User 2 tries to log in with token of user 1.
+	c2 := client.NewTCPClient()
+	err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1], \"token\": \""+token+"\"}")
+	defer c2.Close()
+	if reply, ok := err.(*types.ErrorReply); !ok || reply.Code != types.ErrCodeUnauthorized {
+		t.Errorf("expected login with foreign token to be rejected, got %v", err)
+	}
+	time.Sleep(testWaitTime)
+	if status, ok := c1.Presence()[2]; ok && status.Online {
+		t.Errorf("expected user 2 not to be online, got %+v", status)
+	}
+}
+
+func TestUDPEncryption(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, server.NewUDPServer(server.WithCodec(types.Binary), server.WithRequiredEncryption()), hub)
+
+	c1 := client.NewUDPClient(client.WithEncryption(), client.WithCodec(types.Binary))
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go c1.ListenIncoming()
+	c2 := client.NewUDPClient(client.WithEncryption())
+	if err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	go c2.ListenIncoming()
+	time.Sleep(testWaitTime)
+
+	if err := c2.SetPresence(types.PresenceBusy, "encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testWaitTime)
+
+	expected := types.StatusChangeReply{UserID: 2, Online: true, Presence: types.PresenceBusy, Message: "encrypted"}
+	if status := c1.Presence()[2]; status != expected {
+		t.Errorf("expected user 2 status %+v, got %+v", expected, status)
+	}
+
+	plain := client.NewUDPClient()
+	if err := plain.Connect(serveAddr, "{\"user_id\":3, \"friends\": [1]}"); err == nil {
+		plain.Close()
+		t.Error("expected plain client to be rejected")
+	}
+	legacy := client.NewUDPClient(client.WithLineProtocol())
+	err := legacy.Connect(serveAddr, "{\"user_id\":4, \"friends\": [1]}")
+	defer legacy.Close()
+	if reply, ok := err.(*types.ErrorReply); !ok || reply.Code != types.ErrCodeHandshakeRequired {
+		t.Errorf("expected legacy client login to be rejected, got %v", err)
+	}
+	if _, ok := c1.Presence()[3]; ok {
+		t.Error("expected plain clients not to log in")
+	}
+}
+
+// shutdownTimeout limits how long test servers wait for clients on
+// cleanup. Clients are closed by then and won't answer anything.
+const shutdownTimeout = 100 * time.Millisecond
+
+// serveOption changes how startServer serves.
+type serveOption func(*serveConfig)
+
+type serveConfig struct {
+	// wrap replaces UDP socket, e.g. to lose datagrams.
+	wrap func(net.PacketConn) net.PacketConn
+}
+
+// withPacketConn makes UDP server read and write through the wrapper.
+func withPacketConn(wrap func(net.PacketConn) net.PacketConn) serveOption {
+	return func(c *serveConfig) {
+		c.wrap = wrap
+	}
+}
+
+// startServer registers hub handlers and serves srv on a random local
+// port until test finishes. Server is listening once startServer returns,
+// so clients could connect right away to the returned address.
+//
+// Handlers block once hub is stopped, so tests stop it in cleanup
+// registered before, which runs after server is shut down.
+func startServer(t *testing.T, srv server.Friends, hub *server.Hub, opts ...serveOption) string {
+	t.Helper()
+	var config serveConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	srv.Handle(hub.IncomingMessageHandler)
+	srv.HandleDisconnect(hub.DisconnectHandler)
+
+	var addr string
+	var serve func() error
+	switch s := srv.(type) {
+	case *server.UDPServer:
+		p, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = p.LocalAddr().String()
+		if config.wrap != nil {
+			p = config.wrap(p)
+		}
+		serve = func() error { return s.Serve(p) }
+	case interface{ Serve(net.Listener) error }:
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = ln.Addr().String()
+		serve = func() error { return s.Serve(ln) }
+	default:
+		t.Fatalf("could not serve %T", srv)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+		select {
+		case err := <-serveErr:
+			if err != server.ErrServerClosed {
+				t.Errorf("expected server closed error, got %v", err)
+			}
+		case <-time.After(shutdownTimeout):
+			// Test stopped hub itself and UDP read loop is blocked.
+		}
+	})
+	return addr
+}
+
+// alternateFraming returns client func which creates clients using
+// length prefixed frames and legacy newline messages in turns.
+func alternateFraming(newClient func(opts ...client.Option) client.Friends) ClientFunc {
+	line := false
+	return func() client.Friends {
+		line = !line
+		if line {
+			return newClient(client.WithLineProtocol())
+		}
+		return newClient()
+	}
+}
+
 func testServerClient(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc) {
 	hub := server.NewHub()
 	checkTicker := time.NewTicker(checkStateInterval)
@@ -61,17 +527,7 @@ func testServerClient(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc
 		"{\"user_id\":4, \"friends\": [3]}",
 	}
 
-	// Start server.
-	srv := serverFunc()
-	srv.Handle(hub.IncomingMessageHandler)
-	go func() {
-		if err := srv.ListenAndServe(serveAddr); err != nil {
-			t.Fatal(err)
-		}
-	}()
-
-	// Wait for server to start.
-	time.Sleep(testWaitTime)
+	serveAddr := startServer(t, serverFunc(), hub)
 
 	// Cleanup clients.
 	defer func() {
@@ -99,6 +555,24 @@ func testServerClient(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc
 
 	done <- struct{}{}
 
+	// Users should see friends which were online before they logged in
+	// and would send them status changes.
+	if !clients[1].Presence()[1].Online {
+		t.Errorf("expected user 2 to see user 1 online, got %v", clients[1].Presence())
+	}
+	// User 3 does not list user 4.
+	if clients[3].Presence()[3].Online {
+		t.Errorf("expected user 4 to see user 3 offline, got %v", clients[3].Presence())
+	}
+
+	for i, c := range clients {
+		select {
+		case err := <-c.Errors():
+			t.Errorf("unexpected server error for user %d: %v", i+1, err)
+		default:
+		}
+	}
+
 	expectedUsersLen := len(users)
 	actualUsersLen := len(hub.Users())
 	if expectedUsersLen != actualUsersLen {
@@ -0,0 +1,146 @@
+package test
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/client"
+	"github.com/anjmao/friends/pkg/server"
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// lossyConn drops given share of datagrams written by the server
+// once loss is enabled. First pass datagrams are never dropped.
+type lossyConn struct {
+	net.PacketConn
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	loss    float64
+	pass    int
+	dropped int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.pass <= 0 && c.rand.Float64() < c.loss
+	c.pass--
+	if drop {
+		c.dropped++
+	}
+	c.mu.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *lossyConn) setLoss(loss float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loss = loss
+}
+
+func (c *lossyConn) droppedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+func TestUDPReliableDelivery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+
+	var conn *lossyConn
+	serveAddr := startServer(t, server.NewUDPServer(), hub, withPacketConn(func(p net.PacketConn) net.PacketConn {
+		conn = &lossyConn{PacketConn: p, rand: rand.New(rand.NewSource(1))}
+		return conn
+	}))
+
+	c1 := client.NewUDPClient()
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go c1.ListenIncoming()
+	c2 := client.NewUDPClient()
+	if err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	time.Sleep(testWaitTime)
+
+	// Half of notifications are lost, but user 1 must
+	// eventually see the last status of user 2.
+	conn.setLoss(0.5)
+	presences := []types.Presence{types.PresenceAway, types.PresenceBusy, types.PresenceOnline}
+	var expected types.StatusChangeReply
+	for i := 0; i < 10; i++ {
+		presence := presences[i%len(presences)]
+		message := string(rune('a' + i))
+		if err := c2.SetPresence(presence, message); err != nil {
+			t.Fatal(err)
+		}
+		expected = types.StatusChangeReply{UserID: 2, Online: true, Presence: presence, Message: message}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c1.Presence()[2] != expected && time.Now().Before(deadline) {
+		time.Sleep(testWaitTime)
+	}
+	if status := c1.Presence()[2]; status != expected {
+		t.Errorf("expected user 2 status %+v, got %+v", expected, status)
+	}
+	if conn.droppedCount() == 0 {
+		t.Error("expected some datagrams to be dropped")
+	}
+}
+
+func TestUDPLoginTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+
+	// Only hello reply reaches the client.
+	var conn *lossyConn
+	serveAddr := startServer(t, server.NewUDPServer(), hub, withPacketConn(func(p net.PacketConn) net.PacketConn {
+		conn = &lossyConn{PacketConn: p, rand: rand.New(rand.NewSource(1)), loss: 1, pass: 1}
+		return conn
+	}))
+
+	c := client.NewUDPClient()
+	err := c.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}")
+	defer c.Close()
+	if err == nil {
+		t.Fatal("expected connect to fail when login is not accepted")
+	}
+	if !strings.Contains(err.Error(), "did not accept login") {
+		t.Errorf("expected login timeout, got %v", err)
+	}
+
+	// Login is accepted even if half of replies are lost.
+	conn.setLoss(0.5)
+	c = client.NewUDPClient()
+	if err := c.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+}
@@ -0,0 +1,287 @@
+package test
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/client"
+	"github.com/anjmao/friends/pkg/server"
+	"github.com/anjmao/friends/pkg/types"
+)
+
+// natProxy forwards datagrams between a single client and the server
+// like a NAT. Rebinding makes the server see client from a new address.
+type natProxy struct {
+	conn   net.PacketConn
+	server net.Addr
+
+	mu       sync.Mutex
+	client   net.Addr
+	upstream net.PacketConn
+	last     []byte
+}
+
+func newNATProxy(t *testing.T, serverAddr string) *natProxy {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &natProxy{conn: conn, server: raddr}
+	p.rebind(t)
+	go p.forwardRequests()
+	return p
+}
+
+// rebind replaces upstream socket, replies sent to the old one are lost.
+func (p *natProxy) rebind(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	old := p.upstream
+	p.upstream = upstream
+	p.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go p.forwardReplies(upstream)
+}
+
+func (p *natProxy) forwardRequests() {
+	buffer := make([]byte, 65507)
+	for {
+		n, addr, err := p.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.client = addr
+		p.last = append(p.last[:0], buffer[:n]...)
+		upstream := p.upstream
+		p.mu.Unlock()
+		upstream.WriteTo(buffer[:n], p.server)
+	}
+}
+
+func (p *natProxy) forwardReplies(upstream net.PacketConn) {
+	buffer := make([]byte, 65507)
+	for {
+		n, _, err := upstream.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		client := p.client
+		p.mu.Unlock()
+		p.conn.WriteTo(buffer[:n], client)
+	}
+}
+
+// lastRequest returns the last datagram client sent through the proxy.
+func (p *natProxy) lastRequest() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.last...)
+}
+
+// Addr returns address clients should send datagrams to.
+func (p *natProxy) Addr() string {
+	return p.conn.LocalAddr().String()
+}
+
+func (p *natProxy) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.Close()
+	p.upstream.Close()
+}
+
+// migrationWaitTime is long enough for client to send a ping.
+const migrationWaitTime = 300 * time.Millisecond
+
+func TestUDPAddressMigration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, server.NewUDPServer(), hub)
+
+	nat := newNATProxy(t, serveAddr)
+	defer nat.Close()
+
+	for _, encrypt := range []bool{false, true} {
+		var opts []client.Option
+		if encrypt {
+			opts = append(opts, client.WithEncryption())
+		}
+		c1 := client.NewUDPClient(opts...)
+		if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+			t.Fatal(err)
+		}
+		go c1.ListenIncoming()
+		// Each client gets its own NAT mapping.
+		nat.rebind(t)
+		c2 := client.NewUDPClient(opts...)
+		if err := c2.Connect(nat.Addr(), "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+			t.Fatal(err)
+		}
+		go c2.ListenIncoming()
+		go c2.PingLoop()
+		time.Sleep(testWaitTime)
+
+		nat.rebind(t)
+		if err := c2.SetPresence(types.PresenceBusy, "moved"); err != nil {
+			t.Fatal(err)
+		}
+		// Plain sessions are moved by the next ping.
+		time.Sleep(migrationWaitTime)
+		expected := types.StatusChangeReply{UserID: 2, Online: true, Presence: types.PresenceBusy, Message: "moved"}
+		if status := c1.Presence()[2]; status != expected {
+			t.Errorf("encrypt=%v: expected user 2 status %+v after rebinding, got %+v", encrypt, expected, status)
+		}
+
+		// Replies reach user 2 at the new address.
+		if err := c1.SetPresence(types.PresenceAway, "here"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(testWaitTime)
+		expected = types.StatusChangeReply{UserID: 1, Online: true, Presence: types.PresenceAway, Message: "here"}
+		if status := c2.Presence()[1]; status != expected {
+			t.Errorf("encrypt=%v: expected user 1 status %+v at new address, got %+v", encrypt, expected, status)
+		}
+
+		c1.Close()
+		c2.Close()
+		time.Sleep(testWaitTime)
+	}
+}
+
+func TestUDPIdleSessionExpiry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, server.NewUDPServer(server.WithIdleTimeout(300*time.Millisecond)), hub)
+
+	c1 := client.NewUDPClient()
+	if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go c1.ListenIncoming()
+	go c1.PingLoop()
+
+	// User 2 stops sending anything without logging out.
+	p, err := net.Dial("udp", serveAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	login, _ := types.EncodeMsg(types.CmdLogin, &types.LoginRequest{UserID: 2, Friends: []int{1}})
+	if _, err := p.Write(login); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(testWaitTime)
+	if !c1.Presence()[2].Online {
+		t.Fatalf("expected user 2 to be online, got %+v", c1.Presence()[2])
+	}
+
+	// Ping timeout is never checked, only idle expiry logs user 2 out.
+	time.Sleep(time.Second)
+	if status := c1.Presence()[2]; status.Online {
+		t.Errorf("expected idle user 2 to be offline, got %+v", status)
+	}
+}
+
+func TestUDPSessionHijack(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, server.NewUDPServer(), hub)
+
+	nat := newNATProxy(t, serveAddr)
+	defer nat.Close()
+
+	for _, encrypt := range []bool{false, true} {
+		var opts []client.Option
+		if encrypt {
+			opts = append(opts, client.WithEncryption())
+		}
+		c1 := client.NewUDPClient(opts...)
+		if err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}"); err != nil {
+			t.Fatal(err)
+		}
+		go c1.ListenIncoming()
+		nat.rebind(t)
+		c2 := client.NewUDPClient(opts...)
+		if err := c2.Connect(nat.Addr(), "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+			t.Fatal(err)
+		}
+		go c2.ListenIncoming()
+		if err := c2.SetPresence(types.PresenceBusy, "mine"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(testWaitTime)
+
+		// Attacker saw session ID on the wire and sends plain
+		// hello and ping without session token with it.
+		id, _, err := types.DecodeSessionDatagram(nat.lastRequest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		attacker, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		raddr, _ := net.ResolveUDPAddr("udp", serveAddr)
+		hello, _ := types.EncodeFrame(types.JSON, types.CmdHello, &types.HelloRequest{Version: types.ProtocolVersion})
+		ping, _ := types.EncodeFrame(types.JSON, types.CmdPing, &types.PingRequest{UserID: 2})
+		for _, b := range [][]byte{hello, ping} {
+			if _, err := attacker.WriteTo(types.EncodeSessionDatagram(id, b), raddr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(testWaitTime)
+
+		if err := c1.SetPresence(types.PresenceAway, "here"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(testWaitTime)
+		expected := types.StatusChangeReply{UserID: 1, Online: true, Presence: types.PresenceAway, Message: "here"}
+		if status := c2.Presence()[1]; status != expected {
+			t.Errorf("encrypt=%v: expected user 1 status %+v at client address, got %+v", encrypt, expected, status)
+		}
+		attacker.SetReadDeadline(time.Now().Add(testWaitTime))
+		if n, _, err := attacker.ReadFrom(make([]byte, 65507)); err == nil {
+			t.Errorf("encrypt=%v: expected attacker to receive nothing, got %d bytes", encrypt, n)
+		}
+
+		attacker.Close()
+		c1.Close()
+		c2.Close()
+		time.Sleep(testWaitTime)
+	}
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anjmao/friends/pkg/client"
+	"github.com/anjmao/friends/pkg/server"
+)
+
+func TestTLS(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	certs := generateCertificates(t)
+	tests := []struct {
+		name string
+		// clientCA makes server require client certificates.
+		clientCA string
+		// clientCert is presented by the client if set.
+		clientCert string
+		clientKey  string
+		connected  bool
+	}{
+		{name: "server certificate", connected: true},
+		{
+			name:       "client certificate",
+			clientCA:   certs.ca,
+			clientCert: certs.clientCert,
+			clientKey:  certs.clientKey,
+			connected:  true,
+		},
+		{name: "missing client certificate", clientCA: certs.ca, connected: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(tt *testing.T) {
+			serverTLS, err := server.LoadTLSConfig(certs.serverCert, certs.serverKey, test.clientCA)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			clientTLS, err := client.LoadTLSConfig(certs.ca, test.clientCert, test.clientKey)
+			if err != nil {
+				tt.Fatal(err)
+			}
+			clientTLS.ServerName = "localhost"
+
+			serverFunc := func() server.Friends { return server.NewTCPServer(server.WithTLS(serverTLS)) }
+			clientFunc := func() client.Friends { return client.NewTCPClient(client.WithTLS(clientTLS)) }
+			testTLS(tt, clientFunc, serverFunc, test.connected)
+		})
+	}
+}
+
+func testTLS(t *testing.T, clientFunc ClientFunc, serverFunc ServerFunc, connected bool) {
+	hub := server.NewHub()
+	checkTicker := make(chan time.Time)
+	done := make(chan struct{})
+	go hub.Run(checkTicker, done)
+	t.Cleanup(func() { close(done) })
+	serveAddr := startServer(t, serverFunc(), hub)
+
+	c1 := clientFunc()
+	err := c1.Connect(serveAddr, "{\"user_id\":1, \"friends\": [2]}")
+	if !connected {
+		if err == nil {
+			c1.Close()
+			t.Fatal("expected connection without client certificate to fail")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	go c1.ListenIncoming()
+
+	c2 := clientFunc()
+	if err := c2.Connect(serveAddr, "{\"user_id\":2, \"friends\": [1]}"); err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	time.Sleep(testWaitTime)
+
+	if !c1.Presence()[2].Online {
+		t.Errorf("expected user 1 to see user 2 online over TLS, got %v", c1.Presence())
+	}
+
+	// Plain TCP clients could not talk to TLS server.
+	plain := client.NewTCPClient()
+	if err := plain.Connect(serveAddr, "{\"user_id\":3, \"friends\": [1]}"); err == nil {
+		plain.Close()
+		t.Error("expected plain client to fail")
+	}
+}
+
+// certificates holds paths of PEM files generated for the test.
+type certificates struct {
+	ca         string
+	serverCert string
+	serverKey  string
+	clientCert string
+	clientKey  string
+}
+
+// generateCertificates creates CA and server and client
+// certificates signed by it in test temp dir.
+func generateCertificates(t *testing.T) certificates {
+	dir := t.TempDir()
+	caKey := generateKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "friends test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("could not create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := certificates{ca: filepath.Join(dir, "ca.pem")}
+	writePEM(t, certs.ca, "CERTIFICATE", caDER)
+	certs.serverCert, certs.serverKey = generateLeaf(t, dir, "server", ca, caKey, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	certs.clientCert, certs.clientKey = generateLeaf(t, dir, "client", ca, caKey, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "friends client"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return certs
+}
+
+func generateLeaf(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, template *x509.Certificate) (string, string) {
+	key := generateKey(t)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("could not create %s certificate: %v", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}